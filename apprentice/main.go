@@ -5,11 +5,7 @@ import (
 	"log"
 	"os"
 
-	"github.com/postfix/golibmagic/parser"
-
-	"github.com/postfix/golibmagic/interpreter"
-
-	"github.com/postfix/golibmagic/util"
+	"github.com/postfix/golibmagic"
 )
 
 func main() {
@@ -20,35 +16,18 @@ func main() {
 
 	target := os.Args[1]
 
-	r, err := os.Open(target)
-	if err != nil {
-		panic(err)
-	}
-
-	stats, err := r.Stat()
-	if err != nil {
-		panic(err)
-	}
-
-	sr := util.NewSliceReader(r, 0, stats.Size())
-
-	book := make(parser.Spellbook)
-	pc := &parser.ParseContext{
-		Logf: log.Printf,
-	}
-	err = pc.ParseAll("Magdir", book)
+	m, err := golibmagic.New(
+		golibmagic.WithParserLogger(log.Printf),
+		golibmagic.WithInterpreterLogger(log.Printf),
+	)
 	if err != nil {
 		panic(err)
 	}
+	defer m.Close()
 
-	ic := &interpreter.InterpretContext{
-		Logf: log.Printf,
-		Book: book,
-	}
-
-	res, err := ic.Identify(sr)
+	res, err := m.LookupFile(target)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("%s: %s\n", target, util.MergeStrings(res))
+	fmt.Printf("%s: %s\n", target, res)
 }
@@ -0,0 +1,107 @@
+package golibmagic
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/postfix/golibmagic/compiler"
+	"github.com/postfix/golibmagic/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookupCase is a set of rules, and what they should say about some data
+type lookupCase struct {
+	rules    string
+	data     string
+	expected string
+}
+
+// checkLookups runs every case through the interpreter, then through code
+// generated by the compiler, so that both backends are held to the same table
+func checkLookups(t *testing.T, cases []lookupCase) {
+	for _, c := range cases {
+		assert.Equal(t, c.expected, lookup(t, c.rules, []byte(c.data), WithStrictParsing(), WithLocation(time.UTC)), "interpreted, %q on %q", c.rules, c.data)
+	}
+
+	for i, res := range compiledLookups(t, cases) {
+		c := cases[i]
+		assert.Equal(t, c.expected, res, "compiled, %q on %q", c.rules, c.data)
+	}
+}
+
+// compiledLookups compiles each case into its own package, and identifies
+// its data with a single program that uses all of them
+func compiledLookups(t *testing.T, cases []lookupCase) []string {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("compiling generated code takes a while")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go tool not available")
+	}
+
+	// a leading underscore keeps it out of ./...
+	dir, err := os.MkdirTemp(".", "_compiled")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mod := "github.com/postfix/golibmagic/" + filepath.Base(dir)
+
+	var imports, body strings.Builder
+	for i, c := range cases {
+		pkg := fmt.Sprintf("c%d", i)
+
+		book := make(parser.Spellbook)
+		pctx := &parser.ParseContext{Logf: noLogf, Strict: true}
+		magdir := fstest.MapFS{"test": &fstest.MapFile{Data: []byte(c.rules)}}
+		require.NoError(t, pctx.ParseFS(magdir, ".", book))
+
+		require.NoError(t, os.Mkdir(filepath.Join(dir, pkg), 0o755))
+		require.NoError(t, compiler.Compile(book, filepath.Join(dir, pkg, "gen.go"), false, false, pkg))
+
+		fmt.Fprintf(&imports, "\t%q\n", mod+"/"+pkg)
+		fmt.Fprintf(&body, "\t%s.Location = time.UTC\n", pkg)
+		fmt.Fprintf(&body, "\tidentify(%s.Identify, %q)\n", pkg, c.data)
+	}
+
+	main := "package main\n\n" +
+		"import (\n" +
+		"\t\"fmt\"\n" +
+		"\t\"strings\"\n" +
+		"\t\"time\"\n\n" +
+		"\t\"github.com/postfix/golibmagic/magic\"\n" +
+		"\t\"github.com/postfix/golibmagic/util\"\n" +
+		imports.String() +
+		")\n\n" +
+		"func identify(f func(*util.SliceReader, int64) *magic.Result, data string) {\n" +
+		"\tsr := util.NewSliceReader(strings.NewReader(data), 0, int64(len(data)))\n" +
+		"\tfmt.Printf(\"%q\\n\", f(sr, 0).Description)\n" +
+		"}\n\n" +
+		"func main() {\n" +
+		body.String() +
+		"}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(main), 0o644))
+
+	cmd := exec.Command("go", "run", "./"+filepath.Base(dir))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	require.NoError(t, err)
+
+	var results []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		res, err := strconv.Unquote(line)
+		require.NoError(t, err, "in %q", line)
+		results = append(results, res)
+	}
+	require.Len(t, results, len(cases))
+	return results
+}
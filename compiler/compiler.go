@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/postfix/golibmagic/magic"
 	"github.com/postfix/golibmagic/parser"
 )
 
@@ -88,7 +89,9 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 	withIndent(func() {
 		emit(strconv.Quote("fmt"))
 		emit(strconv.Quote("encoding/binary"))
-		emit(strconv.Quote("github.com/postfix/golibmagic"))
+		emit(strconv.Quote("regexp"))
+		emit(strconv.Quote("time"))
+		emit(strconv.Quote("github.com/postfix/golibmagic/magic"))
 		emit(strconv.Quote("github.com/postfix/golibmagic/util"))
 	})
 	emit(")")
@@ -97,25 +100,34 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 	emit("// silence import errors, if we don't use string/search etc.")
 	emit("var _ magic.StringTestFlags")
 	emit("var _ fmt.State")
+	emit("var _ regexp.Regexp")
 
 	emit("var l binary.ByteOrder=binary.LittleEndian")
 	emit("var b binary.ByteOrder=binary.BigEndian")
+	emit("var m binary.ByteOrder=magic.MiddleEndian")
 	emit("var gt=magic.StringTest")
 	emit("var ht=magic.SearchTest")
+	emit("var xt=magic.RegexTest")
+	emit("var pt=magic.PstringTest")
+	emit("var wt=magic.String16Test")
 	emit("var t=true")
 	emit("var f=false")
 	emit("var tb=make([]byte, 8)")
 	emit("")
+	emit("// Location is the time zone local dates are shown in")
+	emit("var Location=time.Local")
+	emit("")
 
 	for _, byteWidth := range []byte{1, 2, 4, 8} {
-		for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian} {
+		for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian, parser.MiddleEndian} {
 			retType := "uint64"
 
 			emit("// reads an unsigned %d-bit %s integer", byteWidth*8, endianness)
 			emit("func f%d%s(r *util.SliceReader, off int64) (%s, bool) {", byteWidth, endiannessString(endianness, false), retType)
 			withIndent(func() {
-				emit("n,err:=r.ReadAt(tb,int64(off))")
-				emit("if n<%d||err!=nil {return 0,f}", byteWidth)
+				emit("if off<0||off+%d>r.Size() {return 0,f}", byteWidth)
+				emit("n,_:=r.ReadAt(tb[:%d],off)", byteWidth)
+				emit("if n<%d {return 0,f}", byteWidth)
 				if byteWidth == 1 {
 					emit("return %s(tb[0]),t", retType)
 				} else {
@@ -127,6 +139,17 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 		}
 	}
 
+	for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian} {
+		emit("// reads an unsigned 32-bit %s synchsafe integer", endianness)
+		emit("func %s(r *util.SliceReader, off int64) (uint64, bool) {", readerName(4, endianness, false, true))
+		withIndent(func() {
+			emit("v,ok:=%s(r,off)", readerName(4, endianness, false, false))
+			emit("return magic.ID3Value(v),ok")
+		})
+		emit("}")
+		emit("")
+	}
+
 	// sort pages
 	var pages []string
 	for page := range book {
@@ -136,8 +159,17 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 
 	usages := computePagesUsage(book)
 
+	// regular expressions are compiled once, into package-level variables,
+	// and so are der patterns
+	var regexes []string
+	var derPatterns []*magic.DERPattern
+
 	for _, page := range pages {
-		nodes := treeify(book[page])
+		rules := book[page]
+		if page == "" {
+			rules = parser.SortByStrength(rules)
+		}
+		nodes := treeify(rules)
 		usage := usages[page]
 
 		for _, swapEndian := range []bool{false, true} {
@@ -153,27 +185,57 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 				}
 			}
 
-			emit("func Identify%s(r *util.SliceReader, po int64) []string {", pageSymbol(page, swapEndian))
+			isRoot := page == ""
+
+			if isRoot {
+				emit("// Identify returns the result of the first top-level rule that matches")
+				emit("func Identify(r *util.SliceReader, po int64) *magic.Result {")
+				withIndent(func() {
+					emit("rs:=IdentifyAll(r,po,f)")
+					emit("if len(rs)==0 {return &magic.Result{}}")
+					emit("return rs[0]")
+				})
+				emit("}")
+				emit("")
+				emit("// IdentifyAll returns the result of the first top-level rule that matches,")
+				emit("// or of all top-level rules that match if kg (keep going) is true")
+				emit("func IdentifyAll(r *util.SliceReader, po int64, kg bool) []*magic.Result {")
+				withIndent(func() {
+					emit("return identifyAll(r,po,kg,0)")
+				})
+				emit("}")
+				emit("")
+				emit("// identifyAll is IdentifyAll, dp indirect rules deep")
+				emit("func identifyAll(r *util.SliceReader, po int64, kg bool, dp int) []*magic.Result {")
+			} else {
+				emit("func Identify%s(r *util.SliceReader, po int64, s *magic.Result, dp int) {", pageSymbol(page, swapEndian))
+			}
 			withIndent(func() {
-				emit("var out []string")
+				if isRoot {
+					emit("var rs []*magic.Result")
+					emit("s:=&magic.Result{}")
+				}
 				emit("var ss []string; ss=ss[0:]")
 				emit("var gf int64; gf&=gf") // globalOffset
 				emit("var ra uint64; ra&=ra")
 				emit("var rb uint64; rb&=rb")
 				emit("var rc uint64; rc&=rc")
 				emit("var rA int64; rA&=rA")
+				emit("var ro int64; ro&=ro")
+				emit("var rB int64; rB&=rB")
+				emit("var rr *util.SliceReader; _=rr")
+				emit("var rx string; rx+=\"\"")
+				emit("var rF float64; rF+=0")
+				emit("var ri []*magic.Result; ri=ri[0:]")
 				emit("var k bool; k=!!k")
 				emit("var l bool; l=!!l")
 				emit("var m bool; m=!!m")
+				emit("var tx bool; tx=!!tx") // target is text
+				emit("var tk bool; tk=!!tk") // tx is known
 				emit("var d=make([]bool, 32); d[0]=!!d[0]")
+				emit("var g=make([]int64, 32); g[0]+=0") // gf before each level moved it
 				emit("")
 
-				emit("a:=func (args... string) {")
-				withIndent(func() {
-					emit("out=append(out, args...)")
-				})
-				emit("}")
-
 				var emitNode nodeEmitter
 
 				emitNode = func(node *ruleNode, defaultMarker string, prevSiblingNode *ruleNode) {
@@ -190,20 +252,31 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 					// they'll be relative to their own parent
 					emitGlobalOffset := false
 					for _, child := range node.children {
-						cof := child.rule.Offset
-						if cof.IsRelative || (cof.OffsetType == parser.OffsetTypeIndirect && cof.Indirect.IsRelative) {
+						if usesGlobalOffset(child.rule.Offset) {
 							emitGlobalOffset = true
 							break
 						}
 					}
 
+					if emitGlobalOffset {
+						// children start from our match, but our siblings
+						// start from the same place we did
+						emit("g[%d]=gf", rule.Level)
+					}
+
 					var off Expression
 
+					// what the previous node (our parent, or a sibling) read is
+					// still around, unless a sibling's children overwrote it,
+					// or it depends on gf, which our parent moved
+					canReuse := prevSiblingNode != nil && !usesGlobalOffset(rule.Offset) &&
+						(prevSiblingNode.rule.Level < rule.Level || len(prevSiblingNode.children) == 0)
+
 					// if the previous node has exactly the same offset,
 					// then we can reuse their offset without having to
 					// recomput it (especially if it's indirect)
 					reuseOffset := false
-					if prevSiblingNode != nil {
+					if canReuse {
 						pr := prevSiblingNode.rule
 						reuseOffset = pr.Offset.Equals(rule.Offset)
 					}
@@ -235,9 +308,8 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 						}
 
 						if !reuseOffset {
-							emit("ra,k=f%d%s(r,%s)",
-								indirect.ByteWidth,
-								endiannessString(indirect.Endianness, swapEndian),
+							emit("ra,k=%s(r,%s)",
+								readerName(indirect.ByteWidth, indirect.Endianness, swapEndian, indirect.ID3),
 								offsetAddress)
 						}
 						canFail = true
@@ -246,11 +318,14 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 
 						if indirect.OffsetAdjustmentIsRelative {
 							offsetAdjustAddress := fmt.Sprintf("%s + %s", offsetAddress, quoteNumber(indirect.OffsetAdjustmentValue))
-							emit("rb,l=f%d%s(r,%s)",
-								indirect.ByteWidth,
-								endiannessString(indirect.Endianness, swapEndian),
+							emit("rb,l=%s(r,%s)",
+								readerName(indirect.ByteWidth, indirect.Endianness, swapEndian, indirect.ID3),
 								offsetAdjustAddress)
-							emit("if !l {goto %s}", failLabel(node))
+							if indirect.OffsetAdjustmentType == parser.AdjustmentDiv {
+								emit("if !l||rb==0 {goto %s}", failLabel(node))
+							} else {
+								emit("if !l {goto %s}", failLabel(node))
+							}
 							offsetAdjustValue = &VariableAccess{"int64(rb)"}
 						}
 
@@ -294,6 +369,27 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 
 					off = off.Fold()
 
+					if emitGlobalOffset && rule.Offset.IsRelative {
+						// gf is about to move, but the match is where we looked
+						emit("ro=%s", off)
+						off = &VariableAccess{"ro"}
+					}
+
+					// t and b flags restrict a rule to text or binary targets
+					switch rule.Kind.StringTestFlags() & (magic.ForceText | magic.ForceBinary) {
+					case magic.ForceText:
+						canFail = true
+						emit("if !tk {tx=magic.IsText(r); tk=true}")
+						emit("if !tx {goto %s}", failLabel(node))
+					case magic.ForceBinary:
+						canFail = true
+						emit("if !tk {tx=magic.IsText(r); tk=true}")
+						emit("if tx {goto %s}", failLabel(node))
+					}
+
+					// go expression for what the rule read
+					value := "nil"
+
 					switch rule.Kind.Family {
 					case parser.KindFamilySwitch:
 						sk, _ := rule.Kind.Data.(*parser.SwitchKind)
@@ -308,7 +404,8 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 						emit("switch rc {")
 						withIndent(func() {
 							for _, c := range sk.Cases {
-								emit("case %d: a(%s)", c.Value, strconv.Quote(string(c.Description)))
+								caseValue := fmt.Sprintf("%s(rc)", integerType(sk.ByteWidth, sk.Signed))
+								emit("case %s: s.Add(%s)", quoteUnsigned(magic.IntegerBits(uint64(c.Value), sk.ByteWidth)), matchLiteral(c.Rule, off, caseValue))
 							}
 							emit("default: {goto %s}", failLabel(node))
 						})
@@ -317,112 +414,336 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 					case parser.KindFamilyInteger:
 						ik, _ := rule.Kind.Data.(*parser.IntegerKind)
 
-						if !ik.MatchAny {
-							reuseSibling := false
-							if prevSiblingNode != nil {
-								pr := prevSiblingNode.rule
-								if pr.Offset.Equals(rule.Offset) && pr.Kind.Family == parser.KindFamilyInteger {
-									pik, _ := pr.Kind.Data.(*parser.IntegerKind)
-									if pik.ByteWidth == ik.ByteWidth {
-										reuseSibling = true
-									}
+						reuseSibling := false
+						if canReuse {
+							pr := prevSiblingNode.rule
+							if pr.Offset.Equals(rule.Offset) && pr.Kind.Family == parser.KindFamilyInteger {
+								pik, _ := pr.Kind.Data.(*parser.IntegerKind)
+								if pik.ByteWidth == ik.ByteWidth && pik.Endianness == ik.Endianness && pik.ID3 == ik.ID3 {
+									reuseSibling = true
 								}
 							}
+						}
 
+						if ik.MatchAny {
+							// still read it, to report the value
 							if !reuseSibling {
-								emit("rc,m=f%d%s(r,%s)",
-									ik.ByteWidth,
-									endiannessString(ik.Endianness, swapEndian),
+								emit("rc,m=%s(r,%s)",
+									readerName(ik.ByteWidth, ik.Endianness, swapEndian, ik.ID3),
 									off,
 								)
 							}
+							canFail = true
+							emit("if !m {goto %s}", failLabel(node))
+						}
 
-							lhs := "rc"
+						valueExpr := "rc"
+						if ik.DoAnd {
+							valueExpr = fmt.Sprintf("(%s&%s)", valueExpr, quoteUnsigned(ik.AndValue))
+						}
+						// rc is unsigned, and wraps around like the interpreter's int64 would
+						adjustmentValue := quoteUnsigned(uint64(ik.AdjustmentValue))
+						switch ik.AdjustmentType {
+						case parser.AdjustmentAdd:
+							valueExpr = fmt.Sprintf("(%s+%s)", valueExpr, adjustmentValue)
+						case parser.AdjustmentSub:
+							valueExpr = fmt.Sprintf("(%s-%s)", valueExpr, adjustmentValue)
+						case parser.AdjustmentMul:
+							valueExpr = fmt.Sprintf("(%s*%s)", valueExpr, adjustmentValue)
+						case parser.AdjustmentDiv:
+							valueExpr = fmt.Sprintf("uint64(int64(%s)/%s)", valueExpr, quoteNumber(ik.AdjustmentValue))
+						case parser.AdjustmentOr:
+							valueExpr = fmt.Sprintf("(%s|%s)", valueExpr, adjustmentValue)
+						case parser.AdjustmentXor:
+							valueExpr = fmt.Sprintf("(%s^%s)", valueExpr, adjustmentValue)
+						}
+						if ik.Invert {
+							valueExpr = fmt.Sprintf("^%s", valueExpr)
+						}
+						if ik.Date != magic.DateNone {
+							value = fmt.Sprintf("magic.DateValue(%s,%d,%d,Location)", valueExpr, ik.ByteWidth, ik.Date)
+						} else {
+							value = fmt.Sprintf("%s(%s)", integerType(ik.ByteWidth, ik.Signed), valueExpr)
+						}
 
+						if !ik.MatchAny {
+							if !reuseSibling {
+								emit("rc,m=%s(r,%s)",
+									readerName(ik.ByteWidth, ik.Endianness, swapEndian, ik.ID3),
+									off,
+								)
+							}
+
+							var ruleTest string
+							if valueExpr == "rc" && ik.IntegerTest == parser.IntegerTestEqual {
+								// rc is already cut to the right width
+								ruleTest = fmt.Sprintf("m&&rc==%s", quoteUnsigned(magic.IntegerBits(uint64(ik.Value), ik.ByteWidth)))
+							} else {
+								ruleTest = fmt.Sprintf("m&&magic.MatchInteger(%s,%d,%t,%d,%s)",
+									valueExpr, ik.ByteWidth, ik.Signed, ik.IntegerTest, quoteNumber(ik.Value))
+							}
+							canFail = true
+							emit("if !(%s) {goto %s}", ruleTest, failLabel(node))
+						}
+						if emitGlobalOffset {
+							gfValue := &BinaryOp{
+								LHS:      off,
+								Operator: OperatorAdd,
+								RHS:      &NumberLiteral{int64(ik.ByteWidth)},
+							}
+							emit("gf=%s", gfValue.Fold())
+						}
+					case parser.KindFamilyFloat:
+						fk, _ := rule.Kind.Data.(*parser.FloatKind)
+						emit("rc,m=f%d%s(r,%s)",
+							fk.ByteWidth,
+							endiannessString(fk.Endianness, swapEndian),
+							off,
+						)
+						canFail = true
+						emit("if !m {goto %s}", failLabel(node))
+						emit("rF=magic.FloatValue(rc,%d)", fk.ByteWidth)
+						value = "rF"
+
+						if !fk.MatchAny {
 							operator := "=="
-							switch ik.IntegerTest {
-							case parser.IntegerTestEqual:
-								operator = "=="
+							switch fk.FloatTest {
 							case parser.IntegerTestNotEqual:
 								operator = "!="
 							case parser.IntegerTestLessThan:
-								operator = "< "
+								operator = "<"
 							case parser.IntegerTestGreaterThan:
 								operator = ">"
 							}
-
-							if ik.Signed && (ik.IntegerTest == parser.IntegerTestGreaterThan || ik.IntegerTest == parser.IntegerTestLessThan) {
-								lhs = fmt.Sprintf("int64(int%d(%s))", ik.ByteWidth*8, lhs)
-							}
-
-							if ik.DoAnd {
-								lhs = fmt.Sprintf("%s&%s", lhs, quoteNumber(int64(ik.AndValue)))
+							emit("if !(rF %s (%s)) {goto %s}", operator, strconv.FormatFloat(fk.Value, 'g', -1, 64), failLabel(node))
+						}
+						if emitGlobalOffset {
+							gfValue := &BinaryOp{
+								LHS:      off,
+								Operator: OperatorAdd,
+								RHS:      &NumberLiteral{int64(fk.ByteWidth)},
 							}
+							emit("gf=%s", gfValue.Fold())
+						}
 
-							switch ik.AdjustmentType {
-							case parser.AdjustmentAdd:
-								lhs = fmt.Sprintf("(%s+%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentSub:
-								lhs = fmt.Sprintf("(%s-%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentMul:
-								lhs = fmt.Sprintf("(%s*%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentDiv:
-								lhs = fmt.Sprintf("(%s/%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							}
+					case parser.KindFamilyString:
+						sk, _ := rule.Kind.Data.(*parser.StringKind)
 
-							rhs := quoteNumber(ik.Value)
+						reader, index := "r", off.String()
+						if sk.MaxLen > 0 {
+							emit("rr,rB=magic.StringReader(r,%s,%s)", off, quoteNumber(sk.MaxLen))
+							reader, index = "rr", "rB"
+						}
 
-							ruleTest := fmt.Sprintf("m&&%s%s%s", lhs, operator, rhs)
+						if sk.MatchAny || sk.StringTest != parser.IntegerTestEqual {
+							value = "rx"
+							emit("rx,rA=magic.StringValue(%s,%s,%d,%t)", reader, index, sk.Flags, sk.CutAtNewline())
+							test := "rA>=0"
+							switch {
+							case sk.MatchAny:
+							case sk.StringTest == parser.IntegerTestLessThan:
+								test += fmt.Sprintf("&&magic.StringCompare(%s,%s,%s,%d)<0", reader, index, strconv.Quote(string(sk.Value)), sk.Flags)
+							case sk.StringTest == parser.IntegerTestGreaterThan:
+								test += fmt.Sprintf("&&magic.StringCompare(%s,%s,%s,%d)>0", reader, index, strconv.Quote(string(sk.Value)), sk.Flags)
+							}
 							canFail = true
-							emit("if !(%s) {goto %s}", ruleTest, failLabel(node))
+							emit("if !(%s) {goto %s}", test, failLabel(node))
+						} else {
+							value = strconv.Quote(string(sk.Value))
+							emit("rA = gt(%s,%s,%s,%d)", reader, index, strconv.Quote(string(sk.Value)), sk.Flags)
+							canFail = true
+							if sk.Negate {
+								emit("if rA>=0 {goto %s}", failLabel(node))
+							} else {
+								emit("if rA<0 {goto %s}", failLabel(node))
+							}
 						}
-						if emitGlobalOffset {
+						if emitGlobalOffset && !sk.Negate {
 							gfValue := &BinaryOp{
 								LHS:      off,
 								Operator: OperatorAdd,
-								RHS:      &NumberLiteral{int64(ik.ByteWidth)},
+								RHS:      &VariableAccess{"rA"},
 							}
 							emit("gf=%s", gfValue.Fold())
 						}
-					case parser.KindFamilyString:
-						sk, _ := rule.Kind.Data.(*parser.StringKind)
-						emit("rA = gt(r,%s,%s,%d)", off, strconv.Quote(string(sk.Value)), sk.Flags)
+
+					case parser.KindFamilyString16:
+						sk, _ := rule.Kind.Data.(*parser.String16Kind)
+						value = "rx"
+						emit("rx,rA=wt(r,%s,%s,%d,%s)", off, strconv.Quote(string(sk.Value)), sk.Flags, byteOrderString(sk.Endianness, swapEndian))
 						canFail = true
 						if sk.Negate {
 							emit("if rA>=0 {goto %s}", failLabel(node))
 						} else {
 							emit("if rA<0 {goto %s}", failLabel(node))
 						}
-						if emitGlobalOffset {
+						if emitGlobalOffset && !sk.Negate {
+							emit("gf=rA")
+						}
+
+					case parser.KindFamilySearch:
+						sk, _ := rule.Kind.Data.(*parser.SearchKind)
+						value = strconv.Quote(string(sk.Value))
+						emit("rA,rB=ht(r,%s,%s,%s,%d)", off, quoteNumber(int64(sk.MaxLen)), strconv.Quote(string(sk.Value)), sk.Flags)
+						canFail = true
+						if sk.Negate {
+							emit("if rA>=0 {goto %s}", failLabel(node))
+						} else {
+							emit("if rA<0 {goto %s}", failLabel(node))
+						}
+						if emitGlobalOffset && !sk.Negate {
 							gfValue := &BinaryOp{
 								LHS:      off,
 								Operator: OperatorAdd,
-								RHS:      &VariableAccess{"rA"},
+								RHS: &BinaryOp{
+									LHS:      &VariableAccess{"rA"},
+									Operator: OperatorAdd,
+									RHS:      &VariableAccess{"rB"},
+								},
 							}
 							emit("gf=%s", gfValue.Fold())
 						}
 
-					case parser.KindFamilySearch:
-						sk, _ := rule.Kind.Data.(*parser.SearchKind)
-						emit("rA=ht(r,%s,%s,%s)", off, quoteNumber(int64(sk.MaxLen)), strconv.Quote(string(sk.Value)))
+					case parser.KindFamilyPstring:
+						pk, _ := rule.Kind.Data.(*parser.PstringKind)
+						value = "rx"
+						emit("rx,rA,m=pt(r,%s,%s,%d,%d,%s,%t)", off, strconv.Quote(string(pk.Value)), pk.Flags,
+							pk.LengthWidth, byteOrderString(pk.LengthEndianness, swapEndian), pk.LengthIncludesItself)
 						canFail = true
-						emit("if rA<0 {goto %s}", failLabel(node))
+						if pk.Negate {
+							emit("if rA<0||m {goto %s}", failLabel(node))
+						} else {
+							emit("if rA<0||!m {goto %s}", failLabel(node))
+						}
 						if emitGlobalOffset {
 							gfValue := &BinaryOp{
 								LHS:      off,
 								Operator: OperatorAdd,
-								RHS: &BinaryOp{
-									LHS:      &VariableAccess{"rA"},
+								RHS:      &VariableAccess{"rA"},
+							}
+							emit("gf=%s", gfValue.Fold())
+						}
+
+					case parser.KindFamilyRegex:
+						rk, _ := rule.Kind.Data.(*parser.RegexKind)
+						regexVar := fmt.Sprintf("x%d", len(regexes))
+						regexes = append(regexes, magic.RegexSyntax(string(rk.Value), rk.Flags))
+
+						value = "rx"
+						emit("rx,rA=xt(r,%s,%s,%s,%d)", off, regexVar, quoteNumber(rk.Count), rk.Flags)
+						canFail = true
+						if rk.Negate {
+							emit("if rA>=0 {goto %s}", failLabel(node))
+						} else {
+							emit("if rA<0 {goto %s}", failLabel(node))
+						}
+						if emitGlobalOffset && !rk.Negate {
+							var gfValue Expression = &BinaryOp{
+								LHS:      off,
+								Operator: OperatorAdd,
+								RHS:      &VariableAccess{"rA"},
+							}
+							if rk.Flags&magic.RegexOffsetStart == 0 {
+								gfValue = &BinaryOp{
+									LHS:      gfValue,
 									Operator: OperatorAdd,
-									RHS:      &NumberLiteral{int64(len(sk.Value))},
-								},
+									RHS:      &VariableAccess{"int64(len(rx))"},
+								}
 							}
 							emit("gf=%s", gfValue.Fold())
 						}
 
 					case parser.KindFamilyUse:
 						uk, _ := rule.Kind.Data.(*parser.UseKind)
-						emit("a(Identify%s(r,%s)...)", pageSymbol(uk.Page, uk.SwapEndian), off)
+						emit("Identify%s(r,%s,s,dp)", pageSymbol(uk.Page, uk.SwapEndian), off)
+
+					case parser.KindFamilyOffset:
+						ofk, _ := rule.Kind.Data.(*parser.OffsetKind)
+						emit("rA=%s", off)
+						value = "rA"
+
+						test := "rA>=0&&rA<=r.Size()"
+						if !ofk.MatchAny {
+							operator := "=="
+							switch ofk.IntegerTest {
+							case parser.IntegerTestNotEqual:
+								operator = "!="
+							case parser.IntegerTestLessThan:
+								operator = "<"
+							case parser.IntegerTestGreaterThan:
+								operator = ">"
+							}
+							test += fmt.Sprintf("&&rA %s (%s)", operator, quoteNumber(ofk.Value))
+						}
+						canFail = true
+						emit("if !(%s) {goto %s}", test, failLabel(node))
+						if emitGlobalOffset {
+							emit("gf=rA")
+						}
+
+					case parser.KindFamilyGUID:
+						gk, _ := rule.Kind.Data.(*parser.GUIDKind)
+						emit("rx,m=magic.ReadGUID(r,%s)", off)
+						value = "rx"
+						canFail = true
+						if gk.MatchAny {
+							emit("if !m {goto %s}", failLabel(node))
+						} else {
+							emit("if !(m&&rx==%s) {goto %s}", strconv.Quote(gk.Value), failLabel(node))
+						}
+						if emitGlobalOffset {
+							gfValue := &BinaryOp{
+								LHS:      off,
+								Operator: OperatorAdd,
+								RHS:      &NumberLiteral{16},
+							}
+							emit("gf=%s", gfValue.Fold())
+						}
+
+					case parser.KindFamilyDER:
+						dk, _ := rule.Kind.Data.(*parser.DERKind)
+						derVar := "nil"
+						if dk.Pattern != nil {
+							derVar = fmt.Sprintf("e%d", len(derPatterns))
+							derPatterns = append(derPatterns, dk.Pattern)
+						}
+						emit("rx,rA=magic.DERTest(r,%s,%s)", off, derVar)
+						value = "rx"
+						canFail = true
+						emit("if rA<0 {goto %s}", failLabel(node))
+						if emitGlobalOffset {
+							emit("gf=rA")
+						}
+
+					case parser.KindFamilyIndirect:
+						ik, _ := rule.Kind.Data.(*parser.IndirectKind)
+
+						start := off
+						if rule.Offset.OffsetType == parser.OffsetTypeDirect {
+							// offsets are relative to the page by default, not for indirect rules
+							start = &BinaryOp{
+								LHS:      start,
+								Operator: OperatorSub,
+								RHS:      &VariableAccess{"po"},
+							}
+						}
+						if ik.Relative {
+							start = &BinaryOp{
+								LHS:      start,
+								Operator: OperatorAdd,
+								RHS:      &VariableAccess{"po"},
+							}
+						}
+						start = start.Fold()
+						value = fmt.Sprintf("int64(%s)", start)
+
+						canFail = true
+						emit("rA=%s", start)
+						emit("if dp>=magic.MaxIndirectDepth||rA<=0||rA>=r.Size() {goto %s}", failLabel(node))
+						emit("ri=identifyAll(r.Slice(rA),0,f,dp+1)")
+						emit("if len(ri)==0 {goto %s}", failLabel(node))
+						emit("s.Add(%s)", matchLiteral(rule, off, value))
+						emit("s.Include(ri[0],rA)")
 
 					case parser.KindFamilyName:
 						// do nothing, pretty much
@@ -455,8 +776,15 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 					if chatty {
 						emit("fmt.Printf(\"%%s\\n\", %s)", strconv.Quote(rule.Line))
 					}
-					if len(rule.Description) > 0 {
-						emit("a(%s)", strconv.Quote(string(rule.Description)))
+					switch rule.Kind.Family {
+					case parser.KindFamilySwitch:
+						// cases record their own matches
+					case parser.KindFamilyName, parser.KindFamilyClear:
+						// those never count as matches
+					case parser.KindFamilyIndirect:
+						// the match goes before what was found
+					default:
+						emit("s.Add(%s)", matchLiteral(rule, off, value))
 					}
 
 					numChildren := len(node.children)
@@ -479,6 +807,10 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 						}
 					}
 
+					if emitGlobalOffset {
+						emit("gf=g[%d]", rule.Level)
+					}
+
 					if defaultMarker != "" {
 						emit("%s=t", defaultMarker)
 					}
@@ -491,10 +823,22 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 				for _, node := range nodes {
 					switchify(node)
 
+					if isRoot {
+						emit("s.Strength=%d", node.rule.Strength())
+					}
+
 					emitNode(node, "", nil)
+
+					if isRoot {
+						// first match wins, unless we're asked to keep going
+						emit("if s.Description!=\"\" {rs=append(rs,s); if !kg {return rs}}")
+						emit("s=&magic.Result{}")
+					}
 				}
 
-				emit("return out")
+				if isRoot {
+					emit("return rs")
+				}
 			})
 			emit("}")
 			emit("")
@@ -502,6 +846,18 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 
 	}
 
+	if len(regexes) > 0 {
+		// like POSIX regexec, prefer the longest match at the leftmost position
+		emit("func xc(s string) *regexp.Regexp {re:=regexp.MustCompile(s); re.Longest(); return re}")
+	}
+	for i, regex := range regexes {
+		emit("var x%d=xc(%s)", i, strconv.Quote(regex))
+	}
+	for i, dp := range derPatterns {
+		emit("var e%d=&magic.DERPattern{Tag:%d,Len:%d,Value:[]byte(%s)}", i, dp.Tag, dp.Len, strconv.Quote(string(dp.Value)))
+	}
+	emit("")
+
 	fmt.Printf("Compiled in %s\n", time.Since(startTime))
 
 	fSize, _ := f.Seek(0, os.SEEK_CUR)
@@ -524,16 +880,100 @@ func pageSymbol(page string, swapEndian bool) string {
 }
 
 func endiannessString(en parser.Endianness, swapEndian bool) string {
-	if en.MaybeSwapped(swapEndian) == parser.BigEndian {
+	switch en.MaybeSwapped(swapEndian) {
+	case parser.BigEndian:
 		return "b"
+	case parser.MiddleEndian:
+		return "m"
 	}
 	return "l"
 }
 
+// readerName returns the name of the generated function reading an
+// unsigned integer, synchsafe if id3 is set
+func readerName(byteWidth int, en parser.Endianness, swapEndian bool, id3 bool) string {
+	name := fmt.Sprintf("f%d%s", byteWidth, endiannessString(en, swapEndian))
+	if id3 {
+		name += "i"
+	}
+	return name
+}
+
+// byteOrderString returns go code for the binary.ByteOrder of en, for use
+// in rule code, where l, b and m are shadowed by local variables
+func byteOrderString(en parser.Endianness, swapEndian bool) string {
+	switch en.MaybeSwapped(swapEndian) {
+	case parser.BigEndian:
+		return "binary.BigEndian"
+	case parser.MiddleEndian:
+		return "magic.MiddleEndian"
+	}
+	return "binary.LittleEndian"
+}
+
+// matchLiteral returns go code building the magic.Match for a rule
+// that matched at offset off, after reading value
+func matchLiteral(rule parser.Rule, off Expression, value string) string {
+	fields := []string{
+		fmt.Sprintf("Source:%s", strconv.Quote(rule.Source)),
+		fmt.Sprintf("Line:%d", rule.LineNumber),
+		fmt.Sprintf("Level:%d", rule.Level),
+		fmt.Sprintf("Offset:%s", off),
+	}
+
+	if value != "nil" {
+		fields = append(fields, fmt.Sprintf("Value:%s", value))
+	}
+
+	if len(rule.Description) > 0 {
+		description := strconv.Quote(string(rule.Description))
+		if strings.Contains(string(rule.Description), "%") {
+			description = fmt.Sprintf("magic.FormatDescription(%s,%s)", description, value)
+		}
+		fields = append(fields, fmt.Sprintf("Description:%s", description))
+	}
+
+	if rule.Mime != "" {
+		fields = append(fields, fmt.Sprintf("Mime:%s", strconv.Quote(rule.Mime)))
+	}
+
+	if len(rule.Extensions) > 0 {
+		var exts []string
+		for _, ext := range rule.Extensions {
+			exts = append(exts, strconv.Quote(ext))
+		}
+		fields = append(fields, fmt.Sprintf("Extensions:[]string{%s}", strings.Join(exts, ",")))
+	}
+
+	if rule.Apple != "" {
+		fields = append(fields, fmt.Sprintf("Apple:%s", strconv.Quote(rule.Apple)))
+	}
+
+	return fmt.Sprintf("magic.Match{%s}", strings.Join(fields, ","))
+}
+
+// integerType returns the go type holding an integer of the given size and signedness
+func integerType(byteWidth int, signed bool) string {
+	if signed {
+		return fmt.Sprintf("int%d", byteWidth*8)
+	}
+	return fmt.Sprintf("uint%d", byteWidth*8)
+}
+
 func quoteNumber(number int64) string {
 	return fmt.Sprintf("%d", number)
 }
 
+func quoteUnsigned(number uint64) string {
+	return fmt.Sprintf("0x%x", number)
+}
+
+// usesGlobalOffset returns true if an offset is computed from gf, where
+// the parent rule's match ended
+func usesGlobalOffset(o parser.Offset) bool {
+	return o.IsRelative || (o.OffsetType == parser.OffsetTypeIndirect && o.Indirect.IsRelative)
+}
+
 func failLabel(node *ruleNode) string {
 	return fmt.Sprintf("f%x", node.id)
 }
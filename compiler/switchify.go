@@ -3,6 +3,7 @@ package compiler
 import (
 	"fmt"
 
+	"github.com/postfix/golibmagic/magic"
 	"github.com/postfix/golibmagic/parser"
 )
 
@@ -30,6 +31,7 @@ func switchify(node *ruleNode) *ruleNode {
 				sk.Cases = append(sk.Cases, &parser.SwitchCase{
 					Description: child.rule.Description,
 					Value:       ik.Value,
+					Rule:        child.rule,
 				})
 			}
 			newChildren = append(newChildren, &ruleNode{
@@ -55,7 +57,7 @@ func switchify(node *ruleNode) *ruleNode {
 
 		if child.rule.Kind.Family == parser.KindFamilyInteger && len(child.children) == 0 {
 			ik, _ := child.rule.Kind.Data.(*parser.IntegerKind)
-			if ik.IntegerTest == parser.IntegerTestEqual && !ik.DoAnd && ik.AdjustmentType == parser.AdjustmentNone {
+			if ik.IntegerTest == parser.IntegerTestEqual && !ik.MatchAny && !ik.DoAnd && ik.AdjustmentType == parser.AdjustmentNone && ik.Date == magic.DateNone && !ik.ID3 && !ik.Invert {
 				candidate = true
 			}
 		}
@@ -76,6 +78,17 @@ func switchify(node *ruleNode) *ruleNode {
 				if ik.Signed != jk.Signed {
 					endStreak()
 				}
+				if ik.Endianness != jk.Endianness {
+					endStreak()
+				}
+				for _, other := range streak {
+					oik, _ := other.rule.Kind.Data.(*parser.IntegerKind)
+					// both would match, but a switch only takes one case
+					if magic.IntegerBits(uint64(oik.Value), oik.ByteWidth) == magic.IntegerBits(uint64(ik.Value), ik.ByteWidth) {
+						endStreak()
+						break
+					}
+				}
 			}
 			streak = append(streak, child)
 		}
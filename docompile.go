@@ -18,7 +18,8 @@ func doCompile() error {
 	}
 
 	pctx := &parser.ParseContext{
-		Logf: NoLogf,
+		Logf:   NoLogf,
+		Strict: *appArgs.strict,
 	}
 
 	if *appArgs.debugParser {
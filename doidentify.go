@@ -5,61 +5,69 @@ import (
 	"os"
 
 	"github.com/pkg/errors"
-	"github.com/postfix/golibmagic/interpreter"
-	"github.com/postfix/golibmagic/parser"
-	"github.com/postfix/golibmagic/util"
 )
 
 func doIdentify() error {
 	magdir := *identifyArgs.magdir
 
-	NoLogf := func(format string, args ...interface{}) {}
-
 	Logf := func(format string, args ...interface{}) {
 		fmt.Println(fmt.Sprintf(format, args...))
 	}
 
-	pctx := &parser.ParseContext{
-		Logf: NoLogf,
+	opts := []Option{WithMagdir(magdir)}
+
+	var flags Flags
+	if *identifyArgs.mimeType {
+		flags |= MimeType
+	}
+	if *identifyArgs.mime {
+		flags |= Mime
+	}
+	if *identifyArgs.extension {
+		flags |= Extension
+	}
+	if *identifyArgs.apple {
+		flags |= Apple
+	}
+	if *identifyArgs.keepGoing {
+		flags |= KeepGoing
+	}
+	opts = append(opts, WithFlags(flags))
+
+	if *appArgs.strict {
+		opts = append(opts, WithStrictParsing())
 	}
 
 	if *appArgs.debugParser {
-		pctx.Logf = Logf
+		opts = append(opts, WithParserLogger(Logf))
 	}
 
-	book := make(parser.Spellbook)
-	err := pctx.ParseAll(magdir, book)
-	if err != nil {
-		return errors.WithStack(err)
+	if *appArgs.debugInterpreter {
+		opts = append(opts, WithInterpreterLogger(Logf))
 	}
 
-	target := *identifyArgs.target
-	targetReader, err := os.Open(target)
+	m, err := New(opts...)
 	if err != nil {
-		panic(err)
+		return errors.WithStack(err)
 	}
 
-	defer targetReader.Close()
-
-	stat, _ := targetReader.Stat()
+	defer m.Close()
 
-	ictx := &interpreter.InterpretContext{
-		Logf: NoLogf,
-		Book: book,
+	if *identifyArgs.list {
+		return m.List(os.Stdout)
 	}
 
-	if *appArgs.debugInterpreter {
-		ictx.Logf = Logf
+	target := *identifyArgs.target
+	if target == "" {
+		return errors.New("a target is required, unless --list is given")
 	}
 
-	sr := util.NewSliceReader(targetReader, 0, stat.Size())
-
-	result, err := ictx.Identify(sr)
+	result, err := m.LookupFile(target)
 	if err != nil {
-		panic(err)
+		return errors.WithStack(err)
 	}
 
-	fmt.Printf("%s: %s\n", target, util.MergeStrings(result))
+	fmt.Printf("%s: %s\n", target, result)
 
 	return nil
 }
@@ -3,6 +3,8 @@ package interpreter
 import (
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/postfix/golibmagic/magic"
 	"github.com/postfix/golibmagic/parser"
@@ -19,45 +21,133 @@ type LogFunc func(format string, args ...interface{})
 type InterpretContext struct {
 	Logf LogFunc
 	Book parser.Spellbook
+
+	// KeepGoing makes IdentifyAll report every matching top-level rule
+	// instead of stopping at the first one, like `file -k`
+	KeepGoing bool
+
+	// Location is the time zone local dates are shown in,
+	// time.Local if nil
+	Location *time.Location
+
+	sortOnce  sync.Once
+	rootRules []parser.Rule
 }
 
-// Identify follows the rules in a spellbook to find out the type of a file
-func (ctx *InterpretContext) Identify(sr *util.SliceReader) ([]string, error) {
-	outStrings, err := ctx.identifyInternal(sr, 0, "", false)
+// rules returns the rules of a page, with top-level rules sorted by strength
+func (ctx *InterpretContext) rules(page string) []parser.Rule {
+	if page != "" {
+		return ctx.Book[page]
+	}
+
+	ctx.sortOnce.Do(func() {
+		ctx.rootRules = parser.SortByStrength(ctx.Book[""])
+	})
+	return ctx.rootRules
+}
+
+// identifier collects results, one per top-level entry that
+// produced a description
+type identifier struct {
+	keepGoing bool
+	current   *magic.Result
+	results   []*magic.Result
+	// depth is how many indirect rules led to this identification
+	depth int
+
+	// text is whether the target looks like text, once textKnown is set
+	text      bool
+	textKnown bool
+}
+
+// isText classifies the target as text or binary, the first time it's needed
+func (ir *identifier) isText(sr *util.SliceReader) bool {
+	if !ir.textKnown {
+		ir.text = magic.IsText(sr)
+		ir.textKnown = true
+	}
+	return ir.text
+}
+
+func newIdentifier(keepGoing bool) *identifier {
+	return &identifier{
+		keepGoing: keepGoing,
+		current:   &magic.Result{},
+	}
+}
+
+// endEntry wraps up the current top-level entry. It returns true
+// if no other entry should be tried.
+func (ir *identifier) endEntry() bool {
+	if ir.current.Description == "" {
+		// didn't print anything, so it doesn't count as a match
+		ir.current = &magic.Result{}
+		return false
+	}
+
+	ir.results = append(ir.results, ir.current)
+	ir.current = &magic.Result{}
+	return !ir.keepGoing
+}
+
+func (ctx *InterpretContext) identify(sr *util.SliceReader) (*identifier, error) {
+	ir := newIdentifier(ctx.KeepGoing)
+	err := ctx.identifyInternal(ir, sr, 0, "", false)
 	if err != nil {
 		return nil, err
 	}
 
-	return outStrings, nil
+	return ir, nil
 }
 
-func (ctx *InterpretContext) identifyInternal(sr *util.SliceReader, pageOffset int64, page string, swapEndian bool) ([]string, error) {
-	var outStrings []string
+// Identify follows the rules in a spellbook to find out the type of a file.
+// It returns the result of the first top-level rule that matched, which
+// is empty if none did.
+func (ctx *InterpretContext) Identify(sr *util.SliceReader) (*magic.Result, error) {
+	ir, err := ctx.identify(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ir.results) == 0 {
+		return &magic.Result{}, nil
+	}
+	return ir.results[0], nil
+}
+
+// IdentifyAll is like Identify, but returns the results of every
+// top-level rule that matched if KeepGoing is set
+func (ctx *InterpretContext) IdentifyAll(sr *util.SliceReader) ([]*magic.Result, error) {
+	ir, err := ctx.identify(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	return ir.results, nil
+}
 
+func (ctx *InterpretContext) identifyInternal(ir *identifier, sr *util.SliceReader, pageOffset int64, page string, swapEndian bool) error {
 	matchedLevels := make([]bool, MaxLevels)
 	everMatchedLevels := make([]bool, MaxLevels)
-	globalOffset := int64(0)
+	// where the last match at each level ended
+	levelOffsets := make([]int64, MaxLevels)
+
+	rules := ctx.rules(page)
 
-	ctx.Logf("|====> identifying at %d using page %s (%d rules)", pageOffset, page, len(ctx.Book[page]))
+	ctx.Logf("|====> identifying at %d using page %s (%d rules)", pageOffset, page, len(rules))
 
 	if page != "" {
 		matchedLevels[0] = true
 		everMatchedLevels[0] = true
 	}
 
-	for _, rule := range ctx.Book[page] {
-		stopProcessing := false
-
-		// if any of the deeper levels have ever matched, stop working
-		for l := rule.Level + 1; l < len(matchedLevels); l++ {
-			if everMatchedLevels[l] {
-				stopProcessing = true
+	for i, rule := range rules {
+		if page == "" && rule.Level == 0 {
+			// first match wins, unless we're asked to keep going
+			if i > 0 && ir.endEntry() {
 				break
 			}
-		}
-
-		if stopProcessing {
-			break
+			ir.current.Strength = rule.Strength()
 		}
 
 		skipRule := false
@@ -73,6 +163,17 @@ func (ctx *InterpretContext) identifyInternal(sr *util.SliceReader, pageOffset i
 			continue
 		}
 
+		// until proven otherwise, so that rules we bail out of don't
+		// let their children run
+		matchedLevels[rule.Level] = false
+
+		// relative offsets start where the parent matched, like libmagic's
+		// "last up-level field": siblings don't move it for each other
+		globalOffset := int64(0)
+		if rule.Level > 0 {
+			globalOffset = levelOffsets[rule.Level-1]
+		}
+
 		lookupOffset := int64(0)
 
 		ctx.Logf("| %s", rule)
@@ -91,17 +192,27 @@ func (ctx *InterpretContext) identifyInternal(sr *util.SliceReader, pageOffset i
 				ctx.Logf("Error while dereferencing: %s - skipping rule", err.Error())
 				continue
 			}
+			if indirect.ID3 {
+				readAddress = magic.ID3Value(readAddress)
+			}
 			lookupOffset = int64(readAddress)
 
 			offsetAdjustValue := indirect.OffsetAdjustmentValue
 			if indirect.OffsetAdjustmentIsRelative {
 				offsetAdjustAddress := int64(offsetAddress) + offsetAdjustValue
-				readAdjustAddress, err := readAnyUint(sr, int(offsetAdjustAddress), indirect.ByteWidth, indirect.Endianness)
+				readAdjustAddress, err := readAnyUint(sr, int(offsetAdjustAddress), indirect.ByteWidth, indirect.Endianness.MaybeSwapped(swapEndian))
 				if err != nil {
 					ctx.Logf("Error while dereferencing: %s - skipping rule", err.Error())
 					continue
 				}
+				if indirect.ID3 {
+					readAdjustAddress = magic.ID3Value(readAdjustAddress)
+				}
 				offsetAdjustValue = int64(readAdjustAddress)
+				if indirect.OffsetAdjustmentType == parser.AdjustmentDiv && offsetAdjustValue == 0 {
+					ctx.Logf("Indirect offset divides by zero - skipping rule")
+					continue
+				}
 			}
 
 			switch indirect.OffsetAdjustmentType {
@@ -123,111 +234,294 @@ func (ctx *InterpretContext) identifyInternal(sr *util.SliceReader, pageOffset i
 			lookupOffset += globalOffset
 		}
 
-		if lookupOffset < 0 || lookupOffset >= sr.Size() {
+		maxOffset := sr.Size() - 1
+		if rule.Kind.Family == parser.KindFamilyOffset {
+			// pointing right past the end is fine, that's the size of the target
+			maxOffset = sr.Size()
+		}
+
+		if lookupOffset < 0 || lookupOffset > maxOffset {
 			ctx.Logf("we done goofed, lookupOffset %d is out of bounds, skipping %#v", lookupOffset, rule)
 			continue
 		}
 
+		if flags := rule.Kind.StringTestFlags(); flags&(magic.ForceText|magic.ForceBinary) != 0 {
+			if !flags.MatchesClass(ir.isText(sr)) {
+				ctx.Logf("target class doesn't match t/b flags, skipping %#v", rule)
+				continue
+			}
+		}
+
 		success := false
 
+		// what the rule read, for use in the description
+		var value interface{}
+
+		// what an indirect rule found, and where
+		var nested *magic.Result
+		var nestedOffset int64
+
 		switch rule.Kind.Family {
 		case parser.KindFamilyInteger:
 			ik, _ := rule.Kind.Data.(*parser.IntegerKind)
 
-			if ik.MatchAny {
-				success = true
+			targetValue, err := readAnyUint(sr, int(lookupOffset), ik.ByteWidth, ik.Endianness.MaybeSwapped(swapEndian))
+			if err != nil {
+				ctx.Logf("in integer test, while reading target value: %s", err.Error())
+				continue
+			}
+			if ik.ID3 {
+				targetValue = magic.ID3Value(targetValue)
+			}
+
+			if ik.DoAnd {
+				targetValue &= ik.AndValue
+			}
+
+			switch ik.AdjustmentType {
+			case parser.AdjustmentAdd:
+				targetValue = uint64(int64(targetValue) + ik.AdjustmentValue)
+			case parser.AdjustmentSub:
+				targetValue = uint64(int64(targetValue) - ik.AdjustmentValue)
+			case parser.AdjustmentMul:
+				targetValue = uint64(int64(targetValue) * ik.AdjustmentValue)
+			case parser.AdjustmentDiv:
+				targetValue = uint64(int64(targetValue) / ik.AdjustmentValue)
+			case parser.AdjustmentOr:
+				targetValue |= uint64(ik.AdjustmentValue)
+			case parser.AdjustmentXor:
+				targetValue ^= uint64(ik.AdjustmentValue)
+			}
+
+			if ik.Invert {
+				targetValue = ^targetValue
+			}
+
+			if ik.Date != magic.DateNone {
+				value = magic.DateValue(targetValue, ik.ByteWidth, ik.Date, ctx.Location)
 			} else {
-				targetValue, err := readAnyUint(sr, int(lookupOffset), ik.ByteWidth, ik.Endianness)
-				if err != nil {
-					ctx.Logf("in integer test, while reading target value: %s", err.Error())
-					continue
-				}
+				value = magic.IntegerValue(targetValue, ik.ByteWidth, ik.Signed)
+			}
 
-				if ik.DoAnd {
-					targetValue &= ik.AndValue
-				}
+			success = ik.MatchAny || magic.MatchInteger(targetValue, ik.ByteWidth, ik.Signed, ik.IntegerTest, ik.Value)
 
-				switch ik.AdjustmentType {
-				case parser.AdjustmentAdd:
-					targetValue = uint64(int64(targetValue) + ik.AdjustmentValue)
-				case parser.AdjustmentSub:
-					targetValue = uint64(int64(targetValue) - ik.AdjustmentValue)
-				case parser.AdjustmentMul:
-					targetValue = uint64(int64(targetValue) * ik.AdjustmentValue)
-				case parser.AdjustmentDiv:
-					targetValue = uint64(int64(targetValue) / ik.AdjustmentValue)
-				}
+			if success {
+				globalOffset = lookupOffset + int64(ik.ByteWidth)
+			}
 
-				switch ik.IntegerTest {
-				case parser.IntegerTestEqual:
-					success = targetValue == uint64(ik.Value)
-				case parser.IntegerTestNotEqual:
-					success = targetValue != uint64(ik.Value)
-				case parser.IntegerTestLessThan:
-					if ik.Signed {
-						switch ik.ByteWidth {
-						case 1:
-							success = int8(targetValue) < int8(ik.Value)
-						case 2:
-							success = int16(targetValue) < int16(ik.Value)
-						case 4:
-							success = int32(targetValue) < int32(ik.Value)
-						case 8:
-							success = int64(targetValue) < int64(ik.Value)
-						}
-					} else {
-						success = targetValue < uint64(ik.Value)
-					}
-				case parser.IntegerTestGreaterThan:
-					if ik.Signed {
-						switch ik.ByteWidth {
-						case 1:
-							success = int8(targetValue) > int8(ik.Value)
-						case 2:
-							success = int16(targetValue) > int16(ik.Value)
-						case 4:
-							success = int32(targetValue) > int32(ik.Value)
-						case 8:
-							success = int64(targetValue) > int64(ik.Value)
-						}
-					} else {
-						success = targetValue > uint64(ik.Value)
-					}
+		case parser.KindFamilyFloat:
+			fk, _ := rule.Kind.Data.(*parser.FloatKind)
+
+			targetBits, err := readAnyUint(sr, int(lookupOffset), fk.ByteWidth, fk.Endianness.MaybeSwapped(swapEndian))
+			if err != nil {
+				ctx.Logf("in float test, while reading target value: %s", err.Error())
+				continue
+			}
+
+			targetValue := magic.FloatValue(targetBits, fk.ByteWidth)
+			value = targetValue
+
+			switch {
+			case fk.MatchAny:
+				success = true
+			case fk.FloatTest == parser.IntegerTestEqual:
+				success = targetValue == fk.Value
+			case fk.FloatTest == parser.IntegerTestNotEqual:
+				success = targetValue != fk.Value
+			case fk.FloatTest == parser.IntegerTestLessThan:
+				success = targetValue < fk.Value
+			case fk.FloatTest == parser.IntegerTestGreaterThan:
+				success = targetValue > fk.Value
+			}
+
+			if success {
+				globalOffset = lookupOffset + int64(fk.ByteWidth)
+			}
+
+		case parser.KindFamilyString:
+			sk, _ := rule.Kind.Data.(*parser.StringKind)
+
+			stringReader, stringIndex := magic.StringReader(sr, lookupOffset, sk.MaxLen)
+
+			if sk.MatchAny || sk.StringTest != parser.IntegerTestEqual {
+				targetString, span := magic.StringValue(stringReader, stringIndex, sk.Flags, sk.CutAtNewline())
+				if span < 0 {
+					ctx.Logf("in string test, couldn't read string at %d", lookupOffset)
+					continue
+				}
+				value = targetString
+
+				switch {
+				case sk.MatchAny:
+					success = true
+				case sk.StringTest == parser.IntegerTestLessThan:
+					success = magic.StringCompare(stringReader, stringIndex, string(sk.Value), sk.Flags) < 0
+				case sk.StringTest == parser.IntegerTestGreaterThan:
+					success = magic.StringCompare(stringReader, stringIndex, string(sk.Value), sk.Flags) > 0
 				}
 
 				if success {
-					globalOffset = lookupOffset + int64(ik.ByteWidth)
+					globalOffset = lookupOffset + span
+				}
+			} else {
+				matchLen := magic.StringTest(stringReader, stringIndex, string(sk.Value), sk.Flags)
+				success = matchLen >= 0
+				value = string(sk.Value)
+
+				if sk.Negate {
+					success = !success
+				} else {
+					if success {
+						globalOffset = lookupOffset + matchLen
+					}
 				}
 			}
 
-		case parser.KindFamilyString:
-			sk, _ := rule.Kind.Data.(*parser.StringKind)
+		case parser.KindFamilyString16:
+			sk, _ := rule.Kind.Data.(*parser.String16Kind)
 
-			matchLen := magic.StringTest(sr, lookupOffset, string(sk.Value), sk.Flags)
-			success = matchLen >= 0
+			text, matchEnd := magic.String16Test(sr, lookupOffset, string(sk.Value), sk.Flags, sk.Endianness.MaybeSwapped(swapEndian).ByteOrder())
+			success = matchEnd >= 0
+			value = text
 
 			if sk.Negate {
 				success = !success
-			} else {
-				if success {
-					globalOffset = lookupOffset + int64(matchLen)
-				}
+			} else if success {
+				globalOffset = matchEnd
 			}
 
 		case parser.KindFamilySearch:
 			sk, _ := rule.Kind.Data.(*parser.SearchKind)
 
-			matchPos := magic.SearchTest(sr, lookupOffset, sk.MaxLen, string(sk.Value))
+			matchPos, matchLen := magic.SearchTest(sr, lookupOffset, sk.MaxLen, string(sk.Value), sk.Flags)
+			success = matchPos >= 0
+			value = string(sk.Value)
+
+			if sk.Negate {
+				success = !success
+			} else if success {
+				globalOffset = lookupOffset + matchPos + matchLen
+			}
+
+		case parser.KindFamilyPstring:
+			pk, _ := rule.Kind.Data.(*parser.PstringKind)
+
+			contents, span, matched := magic.PstringTest(sr, lookupOffset, string(pk.Value), pk.Flags,
+				pk.LengthWidth, pk.LengthEndianness.MaybeSwapped(swapEndian).ByteOrder(), pk.LengthIncludesItself)
+			if span < 0 {
+				ctx.Logf("in pstring test, couldn't read string at %d", lookupOffset)
+				continue
+			}
+			value = contents
+
+			success = matched != pk.Negate
+			if success {
+				globalOffset = lookupOffset + span
+			}
+
+		case parser.KindFamilyRegex:
+			rk, _ := rule.Kind.Data.(*parser.RegexKind)
+
+			match, matchPos := magic.RegexTest(sr, lookupOffset, rk.Regexp, rk.Count, rk.Flags)
 			success = matchPos >= 0
+			value = match
+
+			if rk.Negate {
+				success = !success
+			} else if success {
+				globalOffset = lookupOffset + matchPos
+				if rk.Flags&magic.RegexOffsetStart == 0 {
+					globalOffset += int64(len(match))
+				}
+			}
 
+		case parser.KindFamilyOffset:
+			ofk, _ := rule.Kind.Data.(*parser.OffsetKind)
+			value = lookupOffset
+
+			switch {
+			case ofk.MatchAny:
+				success = true
+			case ofk.IntegerTest == parser.IntegerTestEqual:
+				success = lookupOffset == ofk.Value
+			case ofk.IntegerTest == parser.IntegerTestNotEqual:
+				success = lookupOffset != ofk.Value
+			case ofk.IntegerTest == parser.IntegerTestLessThan:
+				success = lookupOffset < ofk.Value
+			case ofk.IntegerTest == parser.IntegerTestGreaterThan:
+				success = lookupOffset > ofk.Value
+			}
+
+			if success {
+				globalOffset = lookupOffset
+			}
+
+		case parser.KindFamilyGUID:
+			gk, _ := rule.Kind.Data.(*parser.GUIDKind)
+
+			guid, ok := magic.ReadGUID(sr, lookupOffset)
+			if !ok {
+				ctx.Logf("in guid test, couldn't read guid at %d", lookupOffset)
+				continue
+			}
+			value = guid
+
+			success = gk.MatchAny || guid == gk.Value
+			if success {
+				globalOffset = lookupOffset + 16
+			}
+
+		case parser.KindFamilyDER:
+			dk, _ := rule.Kind.Data.(*parser.DERKind)
+
+			derValue, next := magic.DERTest(sr, lookupOffset, dk.Pattern)
+			success = next >= 0
 			if success {
-				globalOffset = lookupOffset + matchPos + int64(len(sk.Value))
+				value = derValue
+				globalOffset = next
+			}
+
+		case parser.KindFamilyIndirect:
+			ik, _ := rule.Kind.Data.(*parser.IndirectKind)
+
+			start := lookupOffset
+			if rule.Offset.OffsetType == parser.OffsetTypeDirect {
+				// offsets are relative to the page by default, not for indirect rules
+				start -= pageOffset
+			}
+			if ik.Relative {
+				start += pageOffset
+			}
+			value = start
+
+			if ir.depth >= magic.MaxIndirectDepth {
+				ctx.Logf("|====> too many indirections, skipping")
+				continue
+			}
+			if start <= 0 || start >= sr.Size() {
+				continue
+			}
+
+			ctx.Logf("|====> identifying again at %d", start)
+
+			sub := newIdentifier(false)
+			sub.depth = ir.depth + 1
+			err := ctx.identifyInternal(sub, sr.Slice(start), 0, "", false)
+			if err != nil {
+				return err
+			}
+
+			if len(sub.results) > 0 {
+				nested = sub.results[0]
+				nestedOffset = start
+				success = true
 			}
 
 		case parser.KindFamilyDefault:
 			// default tests match if nothing has matched before
 			if !everMatchedLevels[rule.Level] {
 				success = true
+				globalOffset = lookupOffset
 			}
 
 		case parser.KindFamilyUse:
@@ -235,34 +529,61 @@ func (ctx *InterpretContext) identifyInternal(sr *util.SliceReader, pageOffset i
 
 			ctx.Logf("|====> using %s", uk.Page)
 
-			subStrings, err := ctx.identifyInternal(sr, lookupOffset, uk.Page, uk.SwapEndian)
+			err := ctx.identifyInternal(ir, sr, lookupOffset, uk.Page, uk.SwapEndian)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			outStrings = append(outStrings, subStrings...)
+
+			// use rules always match, whatever the page printed
+			success = true
+
+		case parser.KindFamilyName:
+			success = true
 
 		case parser.KindFamilyClear:
 			everMatchedLevels[rule.Level] = false
 		}
 
 		if success {
-			descString := string(rule.Description)
-
 			ctx.Logf("|==========> rule matched!")
 
-			if descString != "" {
-				outStrings = append(outStrings, descString)
+			if rule.Kind.Family != parser.KindFamilyName {
+				ir.current.Add(magic.Match{
+					Source:      rule.Source,
+					Line:        rule.LineNumber,
+					Level:       rule.Level,
+					Offset:      lookupOffset,
+					Value:       value,
+					Description: magic.FormatDescription(string(rule.Description), value),
+					Mime:        rule.Mime,
+					Extensions:  rule.Extensions,
+					Apple:       rule.Apple,
+				})
+			}
+
+			if nested != nil {
+				ir.current.Include(nested, nestedOffset)
 			}
+
 			matchedLevels[rule.Level] = true
 			everMatchedLevels[rule.Level] = true
+			levelOffsets[rule.Level] = globalOffset
+			if rule.Level+1 < MaxLevels {
+				// the children of this rule get a fresh start for default tests
+				everMatchedLevels[rule.Level+1] = false
+			}
 		} else {
 			matchedLevels[rule.Level] = false
 		}
 	}
 
-	ctx.Logf("|====> done identifying at %d using page %s (%d rules)", pageOffset, page, len(ctx.Book[page]))
+	if page == "" {
+		ir.endEntry()
+	}
+
+	ctx.Logf("|====> done identifying at %d using page %s (%d rules)", pageOffset, page, len(rules))
 
-	return outStrings, nil
+	return nil
 }
 
 func readAnyUint(sr *util.SliceReader, j int, byteWidth int, endianness parser.Endianness) (uint64, error) {
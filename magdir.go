@@ -0,0 +1,20 @@
+package golibmagic
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed Magdir
+var embeddedMagdir embed.FS
+
+// DefaultMagdirFS returns the magic files bundled with this module, used
+// when no other database is given to New
+func DefaultMagdirFS() fs.FS {
+	magdir, err := fs.Sub(embeddedMagdir, "Magdir")
+	if err != nil {
+		// can't happen, the folder is embedded at build time
+		panic(err)
+	}
+	return magdir
+}
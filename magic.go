@@ -0,0 +1,302 @@
+package golibmagic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/postfix/golibmagic/interpreter"
+	"github.com/postfix/golibmagic/magic"
+	"github.com/postfix/golibmagic/parser"
+	"github.com/postfix/golibmagic/util"
+)
+
+// ErrClosed is returned when using a Magic handle after Close
+var ErrClosed = errors.New("golibmagic: magic handle is closed")
+
+// Flags select what Magic reports about a target, like libmagic's MAGIC_* flags
+type Flags int
+
+const (
+	// MimeType reports the MIME type instead of a textual description
+	MimeType Flags = 1 << iota
+	// MimeEncoding reports the character set of the target
+	MimeEncoding
+
+	// Extension reports the usual file extensions, separated by slashes
+	Extension
+	// Apple reports the classic Mac OS creator and type codes
+	Apple
+	// KeepGoing reports every matching top-level rule instead of the
+	// first one, like `file -k`
+	KeepGoing
+
+	// Mime reports both the MIME type and the character set, like `file -i`
+	Mime = MimeType | MimeEncoding
+)
+
+// Magic holds a parsed magic database and identifies targets with it
+type Magic struct {
+	flags           Flags
+	magdir          fs.FS
+	strict          bool
+	location        *time.Location
+	parserLogf      parser.LogFunc
+	interpreterLogf interpreter.LogFunc
+
+	ictx *interpreter.InterpretContext
+}
+
+// Option customizes a Magic handle, see New
+type Option func(m *Magic)
+
+// WithMagdir loads magic rules from the given folder instead of the
+// bundled database
+func WithMagdir(magdir string) Option {
+	return WithMagdirFS(os.DirFS(magdir))
+}
+
+// WithMagdirFS loads magic rules from the root of fsys instead of the
+// bundled database
+func WithMagdirFS(fsys fs.FS) Option {
+	return func(m *Magic) {
+		m.magdir = fsys
+	}
+}
+
+// WithFlags changes what lookups report, see Flags
+func WithFlags(flags Flags) Option {
+	return func(m *Magic) {
+		m.flags = flags
+	}
+}
+
+// WithLocation shows local dates in the given time zone instead of time.Local,
+// which is useful for reproducible output
+func WithLocation(loc *time.Location) Option {
+	return func(m *Magic) {
+		m.location = loc
+	}
+}
+
+// WithStrictParsing makes New fail with a parser.ParseErrors if any rule of
+// the database is malformed or unsupported, instead of skipping it
+func WithStrictParsing() Option {
+	return func(m *Magic) {
+		m.strict = true
+	}
+}
+
+// WithParserLogger sets the function receiving the parser's debug output
+func WithParserLogger(logf parser.LogFunc) Option {
+	return func(m *Magic) {
+		m.parserLogf = logf
+	}
+}
+
+// WithInterpreterLogger sets the function receiving the interpreter's debug output
+func WithInterpreterLogger(logf interpreter.LogFunc) Option {
+	return func(m *Magic) {
+		m.interpreterLogf = logf
+	}
+}
+
+func noLogf(format string, args ...interface{}) {}
+
+// New parses a magic database once and returns a handle ready for lookups
+func New(opts ...Option) (*Magic, error) {
+	m := &Magic{
+		magdir:          DefaultMagdirFS(),
+		parserLogf:      noLogf,
+		interpreterLogf: noLogf,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	pctx := &parser.ParseContext{
+		Logf:   m.parserLogf,
+		Strict: m.strict,
+	}
+
+	book := make(parser.Spellbook)
+	err := pctx.ParseFS(m.magdir, ".", book)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	m.ictx = &interpreter.InterpretContext{
+		Logf:      m.interpreterLogf,
+		Book:      book,
+		KeepGoing: m.flags&KeepGoing != 0,
+		Location:  m.location,
+	}
+
+	return m, nil
+}
+
+// Lookup identifies an in-memory buffer
+func (m *Magic) Lookup(data []byte) (string, error) {
+	return m.LookupReaderAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// LookupFile identifies the file at the given path
+func (m *Magic) LookupFile(path string) (string, error) {
+	var res string
+	err := withFile(path, func(f *os.File, size int64) error {
+		var err error
+		res, err = m.LookupReaderAt(f, size)
+		return err
+	})
+	return res, err
+}
+
+// LookupReaderAt identifies the first size bytes of r
+func (m *Magic) LookupReaderAt(r io.ReaderAt, size int64) (string, error) {
+	if m.ictx == nil {
+		return "", ErrClosed
+	}
+
+	sr := util.NewSliceReader(r, 0, size)
+
+	results, err := m.ictx.IdentifyAll(sr)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	first := &magic.Result{}
+	if len(results) > 0 {
+		first = results[0]
+	}
+
+	switch {
+	case m.flags&Mime != 0:
+		return m.formatMime(sr, first), nil
+	case m.flags&Extension != 0:
+		if len(first.Extensions) == 0 {
+			// that's what file(1) prints too
+			return "???", nil
+		}
+		return strings.Join(first.Extensions, "/"), nil
+	case m.flags&Apple != 0:
+		if first.Apple == "" {
+			// that's what file(1) prints too
+			return "UNKNUNKN", nil
+		}
+		return first.Apple, nil
+	}
+
+	var descriptions []string
+	for _, result := range results {
+		descriptions = append(descriptions, result.Description)
+	}
+
+	// that's how file -k separates matches
+	return strings.Join(descriptions, "\n- "), nil
+}
+
+func (m *Magic) formatMime(sr *util.SliceReader, result *magic.Result) string {
+	var parts []string
+
+	encoding := magic.Encoding(sr)
+
+	if m.flags&MimeType != 0 {
+		mime := result.Mime
+		if mime == "" {
+			if encoding == "binary" {
+				mime = "application/octet-stream"
+			} else {
+				mime = "text/plain"
+			}
+		}
+		parts = append(parts, mime)
+	}
+
+	if m.flags&MimeEncoding != 0 {
+		if len(parts) > 0 {
+			encoding = "charset=" + encoding
+		}
+		parts = append(parts, encoding)
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// Identify returns everything the first matching top-level rule found
+// out about an in-memory buffer. Flags don't change its behavior.
+func (m *Magic) Identify(data []byte) (*magic.Result, error) {
+	return m.IdentifyReaderAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// IdentifyFile is Identify, for the file at the given path
+func (m *Magic) IdentifyFile(path string) (*magic.Result, error) {
+	var res *magic.Result
+	err := withFile(path, func(f *os.File, size int64) error {
+		var err error
+		res, err = m.IdentifyReaderAt(f, size)
+		return err
+	})
+	return res, err
+}
+
+// IdentifyReaderAt is Identify, for the first size bytes of r
+func (m *Magic) IdentifyReaderAt(r io.ReaderAt, size int64) (*magic.Result, error) {
+	if m.ictx == nil {
+		return nil, ErrClosed
+	}
+
+	res, err := m.ictx.Identify(util.NewSliceReader(r, 0, size))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return res, nil
+}
+
+func withFile(path string, cb func(f *os.File, size int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return cb(f, stat.Size())
+}
+
+// List prints the top-level rules of the database to w, in the order they
+// are tried, along with their strength, like `file --list`
+func (m *Magic) List(w io.Writer) error {
+	if m.ictx == nil {
+		return ErrClosed
+	}
+
+	for _, rule := range parser.SortByStrength(m.ictx.Book[""]) {
+		if rule.Level > 0 {
+			continue
+		}
+
+		_, err := fmt.Fprintf(w, "Strength = %3d : %s [%s]\n", rule.Strength(), rule.Description, rule.Mime)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// Close releases the magic database. The handle can't be used afterwards.
+func (m *Magic) Close() error {
+	m.ictx = nil
+	return nil
+}
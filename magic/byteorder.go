@@ -0,0 +1,52 @@
+package magic
+
+import "encoding/binary"
+
+// ID3Value decodes a synchsafe integer, as found in ID3 tags, which only
+// uses the low 7 bits of each of its 4 bytes
+func ID3Value(v uint64) uint64 {
+	return v&0x7f | (v>>8)&0x7f<<7 | (v>>16)&0x7f<<14 | (v>>24)&0x7f<<21
+}
+
+// MiddleEndian is the byte order of the PDP-11: 16-bit words are
+// little-endian, but the most significant word of a 32-bit value comes first.
+// 64-bit values are read as two such 32-bit values, most significant first.
+var MiddleEndian binary.ByteOrder = middleEndian{}
+
+type middleEndian struct{}
+
+func (middleEndian) Uint16(b []byte) uint16 {
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (middleEndian) PutUint16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+}
+
+func (middleEndian) Uint32(b []byte) uint32 {
+	_ = b[3] // bounds check hint to compiler
+	return uint32(b[1])<<24 | uint32(b[0])<<16 | uint32(b[3])<<8 | uint32(b[2])
+}
+
+func (middleEndian) PutUint32(b []byte, v uint32) {
+	_ = b[3] // early bounds check
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 24)
+	b[2] = byte(v)
+	b[3] = byte(v >> 8)
+}
+
+func (me middleEndian) Uint64(b []byte) uint64 {
+	_ = b[7] // bounds check hint to compiler
+	return uint64(me.Uint32(b[0:4]))<<32 | uint64(me.Uint32(b[4:8]))
+}
+
+func (me middleEndian) PutUint64(b []byte, v uint64) {
+	_ = b[7] // early bounds check
+	me.PutUint32(b[0:4], uint32(v>>32))
+	me.PutUint32(b[4:8], uint32(v))
+}
+
+func (middleEndian) String() string {
+	return "MiddleEndian"
+}
@@ -0,0 +1,34 @@
+package magic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MiddleEndian(t *testing.T) {
+	b := []byte{0x34, 0x12, 0x78, 0x56, 0xbc, 0x9a, 0xf0, 0xde}
+
+	assert.EqualValues(t, 0x1234, MiddleEndian.Uint16(b))
+	assert.EqualValues(t, 0x12345678, MiddleEndian.Uint32(b))
+	assert.EqualValues(t, uint64(0x123456789abcdef0), MiddleEndian.Uint64(b))
+
+	out := make([]byte, 8)
+	MiddleEndian.PutUint64(out, 0x123456789abcdef0)
+	assert.Equal(t, b, out)
+
+	MiddleEndian.PutUint32(out, 0xcafebabe)
+	assert.Equal(t, []byte{0xfe, 0xca, 0xbe, 0xba}, out[:4])
+
+	MiddleEndian.PutUint16(out, 0xbeef)
+	assert.Equal(t, []byte{0xef, 0xbe}, out[:2])
+}
+
+func Test_ID3Value(t *testing.T) {
+	assert.EqualValues(t, 0, ID3Value(0))
+	assert.EqualValues(t, 129, ID3Value(0x00000101))
+	assert.EqualValues(t, 0x0fffffff, ID3Value(0x7f7f7f7f))
+
+	// the high bit of each byte is ignored
+	assert.EqualValues(t, 0x0fffffff, ID3Value(0xffffffff))
+}
@@ -0,0 +1,48 @@
+package magic
+
+import "time"
+
+// DateFormat describes how an integer holds a timestamp
+type DateFormat int
+
+const (
+	// DateNone means the integer isn't a timestamp
+	DateNone DateFormat = iota
+	// DateUTC is a number of seconds since the Unix epoch, shown in UTC
+	DateUTC
+	// DateLocal is a number of seconds since the Unix epoch, shown in local time
+	DateLocal
+	// DateWindows is a number of 100-nanosecond intervals since
+	// January 1, 1601 (a FILETIME), shown in UTC
+	DateWindows
+)
+
+// dateLayout is the layout of C's asctime, which libmagic uses
+const dateLayout = "Mon Jan _2 15:04:05 2006"
+
+// windowsEpochOffset is the number of seconds between 1601 and 1970
+const windowsEpochOffset = 11644473600
+
+// DateValue renders a timestamp of byteWidth bytes like libmagic does.
+// Local dates are shown in loc, or in time.Local if loc is nil.
+func DateValue(v uint64, byteWidth int, format DateFormat, loc *time.Location) string {
+	seconds := int64(v)
+	if byteWidth == 4 {
+		seconds = int64(uint32(v))
+	}
+
+	var t time.Time
+	switch format {
+	case DateWindows:
+		t = time.Unix(int64(v/10000000)-windowsEpochOffset, 0).UTC()
+	case DateLocal:
+		if loc == nil {
+			loc = time.Local
+		}
+		t = time.Unix(seconds, 0).In(loc)
+	default:
+		t = time.Unix(seconds, 0).UTC()
+	}
+
+	return t.Format(dateLayout)
+}
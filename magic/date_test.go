@@ -0,0 +1,23 @@
+package magic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DateValue(t *testing.T) {
+	zone := time.FixedZone("test", 3600)
+
+	assert.Equal(t, "Sun Sep  9 01:46:40 2001", DateValue(1000000000, 4, DateUTC, zone))
+	assert.Equal(t, "Sun Sep  9 02:46:40 2001", DateValue(1000000000, 4, DateLocal, zone))
+	assert.Equal(t, "Thu Jan  1 00:00:00 1970", DateValue(0, 8, DateUTC, nil))
+
+	// 32-bit dates are unsigned
+	assert.Equal(t, "Sun Feb  7 06:28:15 2106", DateValue(0xffffffff, 4, DateUTC, nil))
+	assert.Equal(t, "Wed Dec 31 23:59:59 1969", DateValue(0xffffffffffffffff, 8, DateUTC, nil))
+
+	// FILETIMEs count 100ns intervals since 1601
+	assert.Equal(t, "Thu Jan  1 00:00:00 1970", DateValue(116444736000000000, 8, DateWindows, zone))
+}
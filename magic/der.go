@@ -0,0 +1,212 @@
+package magic
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// derTagNames are libmagic's names for the universal ASN.1 tags
+var derTagNames = []string{
+	"eoc", "bool", "int", "bit_str", "octet_str", "null", "obj_id", "obj_desc",
+	"ext", "real", "enum", "embed", "utf8_str", "rel_oid", "time", "res2",
+	"seq", "set", "num_str", "prt_str", "t61_str", "vid_str", "ia5_str", "utc_time",
+	"gen_time", "gr_str", "vis_str", "gen_str", "univ_str", "char_str", "bmp_str", "date",
+	"tod", "datetime", "duration", "oid-iri", "rel-oid-iri",
+}
+
+// derTextTags are the tags whose contents are printed as text rather than hex
+var derTextTags = map[string]bool{
+	"utf8_str": true, "num_str": true, "prt_str": true, "t61_str": true,
+	"vid_str": true, "ia5_str": true, "utc_time": true, "gen_time": true,
+	"gr_str": true, "vis_str": true, "gen_str": true, "univ_str": true,
+	"char_str": true,
+}
+
+// derMaxValueLen is how many bytes of an element's contents are shown, at most
+const derMaxValueLen = 64
+
+// DERElement is the header of an ASN.1 DER element
+type DERElement struct {
+	// Tag is the tag number, with the class bits dropped
+	Tag int
+	// Constructed is set if the contents are more elements, like sequences
+	Constructed bool
+	// HeaderLen is the size of the tag and length octets
+	HeaderLen int64
+	// Len is the size of the contents
+	Len int64
+}
+
+// ReadDER reads the header of the DER element at the given index
+func ReadDER(sr *util.SliceReader, targetIndex int64) (DERElement, bool) {
+	var el DERElement
+
+	i := targetIndex
+	b := make([]byte, 1)
+
+	next := func() (int, bool) {
+		if i < 0 {
+			return 0, false
+		}
+		n, _ := sr.ReadAt(b, i)
+		if n < 1 {
+			return 0, false
+		}
+		i++
+		return int(b[0]), true
+	}
+
+	c, ok := next()
+	if !ok {
+		return el, false
+	}
+	el.Constructed = c&0x20 != 0
+	el.Tag = c & 0x1f
+	if el.Tag == 0x1f {
+		// long form, base 128
+		el.Tag = 0
+		for {
+			c, ok = next()
+			if !ok || el.Tag > 1<<20 {
+				return el, false
+			}
+			el.Tag = el.Tag<<7 | c&0x7f
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	c, ok = next()
+	if !ok {
+		return el, false
+	}
+	if c&0x80 == 0 {
+		el.Len = int64(c)
+	} else {
+		numOctets := c & 0x7f
+		if numOctets == 0 || numOctets > 4 {
+			// indefinite lengths aren't DER
+			return el, false
+		}
+		for ; numOctets > 0; numOctets-- {
+			c, ok = next()
+			if !ok {
+				return el, false
+			}
+			el.Len = el.Len<<8 | int64(c)
+		}
+	}
+
+	el.HeaderLen = i - targetIndex
+	if i+el.Len > sr.Size() {
+		return el, false
+	}
+	return el, true
+}
+
+// DERPattern is a parsed der test, like "seq", "int1" or "int1=00"
+type DERPattern struct {
+	// Tag is the tag number the element must have
+	Tag int
+	// Len is the size the contents must have, or -1 for any size
+	Len int64
+	// Value is what the contents must start with, if not empty
+	Value []byte
+}
+
+// ParseDERPattern parses a der test: a tag name like "seq", optionally
+// followed by the length of the contents, then optionally by "=" and the
+// hex-encoded start of the contents
+func ParseDERPattern(pattern string) (*DERPattern, error) {
+	dp := &DERPattern{Tag: -1, Len: -1}
+
+	name := pattern
+	value := ""
+	if i := strings.IndexByte(pattern, '='); i >= 0 {
+		name = pattern[:i]
+		value = pattern[i+1:]
+	}
+
+	lengthStart := strings.IndexAny(name, "0123456789")
+	if lengthStart >= 0 {
+		length, err := strconv.ParseInt(name[lengthStart:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid der length in %s", pattern)
+		}
+		dp.Len = length
+		name = name[:lengthStart]
+	}
+
+	for tag, tagName := range derTagNames {
+		if tagName == name {
+			dp.Tag = tag
+		}
+	}
+	if dp.Tag < 0 {
+		return nil, fmt.Errorf("unknown der tag %s", name)
+	}
+
+	if value != "" {
+		decoded, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid der value in %s: %s", pattern, err.Error())
+		}
+		dp.Value = decoded
+	}
+
+	return dp, nil
+}
+
+// DERTest reads the DER element at the given index and checks it against
+// pattern, which matches any element if nil.
+// It returns the contents of the element, as text for string types and hex
+// otherwise, and the offset relative rules go on from: the start of the
+// contents for constructed elements like sequences, so their children can
+// be looked at, and the end of the element otherwise. That offset is -1
+// if the element doesn't match.
+func DERTest(sr *util.SliceReader, targetIndex int64, pattern *DERPattern) (string, int64) {
+	el, ok := ReadDER(sr, targetIndex)
+	if !ok {
+		return "", -1
+	}
+
+	if pattern != nil {
+		if pattern.Tag != el.Tag {
+			return "", -1
+		}
+		if pattern.Len >= 0 && pattern.Len != el.Len {
+			return "", -1
+		}
+		if len(pattern.Value) > 0 {
+			if int64(len(pattern.Value)) > el.Len {
+				return "", -1
+			}
+			actual := make([]byte, len(pattern.Value))
+			n, _ := sr.ReadAt(actual, targetIndex+el.HeaderLen)
+			if n < len(actual) || string(actual) != string(pattern.Value) {
+				return "", -1
+			}
+		}
+	}
+
+	contentsIndex := targetIndex + el.HeaderLen
+
+	contents := make([]byte, min(el.Len, derMaxValueLen))
+	n, _ := sr.ReadAt(contents, contentsIndex)
+	contents = contents[:n]
+
+	value := hex.EncodeToString(contents)
+	if el.Tag < len(derTagNames) && derTextTags[derTagNames[el.Tag]] {
+		value = string(contents)
+	}
+
+	if el.Constructed {
+		return value, contentsIndex
+	}
+	return value, contentsIndex + el.Len
+}
@@ -0,0 +1,75 @@
+package magic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseDERPattern(t *testing.T) {
+	dp, err := ParseDERPattern("seq")
+	assert.NoError(t, err)
+	assert.Equal(t, &DERPattern{Tag: 16, Len: -1}, dp)
+
+	dp, err = ParseDERPattern("int1=00")
+	assert.NoError(t, err)
+	assert.Equal(t, &DERPattern{Tag: 2, Len: 1, Value: []byte{0}}, dp)
+
+	_, err = ParseDERPattern("sequence")
+	assert.Error(t, err)
+	_, err = ParseDERPattern("int=zz")
+	assert.Error(t, err)
+}
+
+func Test_ReadDER(t *testing.T) {
+	el, ok := ReadDER(stringReader("\x30\x03\x02\x01\x00"), 0)
+	assert.True(t, ok)
+	assert.Equal(t, DERElement{Tag: 16, Constructed: true, HeaderLen: 2, Len: 3}, el)
+
+	// long form length
+	el, ok = ReadDER(stringReader("\x04\x81\x01x"), 0)
+	assert.True(t, ok)
+	assert.Equal(t, DERElement{Tag: 4, HeaderLen: 3, Len: 1}, el)
+
+	// long form tag
+	el, ok = ReadDER(stringReader("\x1f\x81\x00\x00"), 0)
+	assert.True(t, ok)
+	assert.Equal(t, DERElement{Tag: 128, HeaderLen: 4, Len: 0}, el)
+
+	// indefinite length, contents past the end
+	_, ok = ReadDER(stringReader("\x30\x80\x00\x00"), 0)
+	assert.False(t, ok)
+	_, ok = ReadDER(stringReader("\x04\x05abc"), 0)
+	assert.False(t, ok)
+}
+
+func Test_DERTest(t *testing.T) {
+	sr := stringReader("\x30\x08\x02\x01\x07\x13\x03abc")
+	seq, _ := ParseDERPattern("seq")
+	version, _ := ParseDERPattern("int1=07")
+	wrongVersion, _ := ParseDERPattern("int1=08")
+	str, _ := ParseDERPattern("prt_str3")
+
+	// constructed elements go on from their contents
+	value, next := DERTest(sr, 0, seq)
+	assert.Equal(t, "020107130361", value[:12])
+	assert.EqualValues(t, 2, next)
+
+	value, next = DERTest(sr, 2, version)
+	assert.Equal(t, "07", value)
+	assert.EqualValues(t, 5, next)
+
+	_, next = DERTest(sr, 2, wrongVersion)
+	assert.EqualValues(t, -1, next)
+	_, next = DERTest(sr, 2, seq)
+	assert.EqualValues(t, -1, next)
+
+	value, next = DERTest(sr, 5, str)
+	assert.Equal(t, "abc", value)
+	assert.EqualValues(t, 10, next)
+
+	// nil matches any element
+	value, next = DERTest(sr, 5, nil)
+	assert.Equal(t, "abc", value)
+	assert.EqualValues(t, 10, next)
+}
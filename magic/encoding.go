@@ -0,0 +1,97 @@
+package magic
+
+import (
+	"unicode/utf8"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// EncodingSniffLen is how many bytes of a target are looked at to guess its encoding
+const EncodingSniffLen = 64 * 1024
+
+// Encoding guesses the character set of a target, as reported by
+// `file --mime-encoding`: "us-ascii", "utf-8", "iso-8859-1", "unknown-8bit"
+// or "binary"
+func Encoding(sr *util.SliceReader) string {
+	buf := make([]byte, min(sr.Size(), EncodingSniffLen))
+	n, _ := sr.ReadAt(buf, 0)
+	buf = buf[:n]
+	truncated := int64(n) < sr.Size()
+
+	if len(buf) == 0 {
+		return "binary"
+	}
+
+	ascii := true
+	for i := 0; i < len(buf); {
+		c := buf[i]
+		if c < utf8.RuneSelf {
+			if !isTextByte(c) {
+				return "binary"
+			}
+			i++
+			continue
+		}
+
+		ascii = false
+		r, size := utf8.DecodeRune(buf[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if truncated && !utf8.FullRune(buf[i:]) {
+				// sequence cut off by the sniff length, give it the benefit of the doubt
+				break
+			}
+			return extendedEncoding(buf)
+		}
+		i += size
+	}
+
+	if ascii {
+		return "us-ascii"
+	}
+	return "utf-8"
+}
+
+// extendedEncoding tells 8-bit text that isn't UTF-8 from binary data,
+// like libmagic's looks_latin1 and looks_extended: ISO-8859 text only uses
+// 0xa0-0xff on top of ASCII text, other extended ASCII also uses 0x80-0x9f
+func extendedEncoding(buf []byte) string {
+	latin1 := true
+	for _, c := range buf {
+		if c < utf8.RuneSelf {
+			if !isTextByte(c) {
+				return "binary"
+			}
+		} else if c < 0xa0 {
+			latin1 = false
+		}
+	}
+
+	if latin1 {
+		return "iso-8859-1"
+	}
+	return "unknown-8bit"
+}
+
+// IsText returns whether a target looks like text rather than binary data,
+// by the same rules as Encoding
+func IsText(sr *util.SliceReader) bool {
+	return Encoding(sr) != "binary"
+}
+
+// MatchesClass returns false if the flags force a text test ("t") and the
+// target is binary, or a binary test ("b") and the target is text
+func (f StringTestFlags) MatchesClass(text bool) bool {
+	switch f & (ForceText | ForceBinary) {
+	case ForceText:
+		return text
+	case ForceBinary:
+		return !text
+	}
+	return true
+}
+
+// isTextByte returns true for the ASCII bytes found in text files:
+// printable characters, and the usual control characters (\a \b \t \n \v \f \r ESC)
+func isTextByte(c byte) bool {
+	return (c >= 0x20 && c < 0x7f) || (c >= 0x07 && c <= 0x0d) || c == 0x1b
+}
@@ -0,0 +1,36 @@
+package magic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Encoding(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected string
+	}{
+		{"hello world\n", "us-ascii"},
+		{"café au lait\n", "utf-8"},
+		{"caf\xe9 au lait\n", "iso-8859-1"},
+		{"\x93quoted\x94\n", "unknown-8bit"},
+		{"caf\xe9\x00", "binary"},
+		{"\x7fELF", "binary"},
+		{"", "binary"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, Encoding(stringReader(c.target)), "%q", c.target)
+		assert.Equal(t, c.expected != "binary", IsText(stringReader(c.target)), "%q", c.target)
+	}
+}
+
+func Test_MatchesClass(t *testing.T) {
+	assert.True(t, StringTestFlags(0).MatchesClass(false))
+	assert.True(t, StringTestFlags(ForceText).MatchesClass(true))
+	assert.False(t, StringTestFlags(ForceText).MatchesClass(false))
+	assert.True(t, StringTestFlags(ForceBinary).MatchesClass(false))
+	assert.False(t, StringTestFlags(ForceBinary).MatchesClass(true))
+	assert.True(t, StringTestFlags(ForceText|ForceBinary).MatchesClass(false))
+}
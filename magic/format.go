@@ -0,0 +1,204 @@
+package magic
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// IntegerValue converts an integer read from a target into a Go value of
+// the right size and signedness, suitable for FormatDescription
+func IntegerValue(v uint64, byteWidth int, signed bool) interface{} {
+	if signed {
+		switch byteWidth {
+		case 1:
+			return int8(v)
+		case 2:
+			return int16(v)
+		case 4:
+			return int32(v)
+		default:
+			return int64(v)
+		}
+	}
+
+	switch byteWidth {
+	case 1:
+		return uint8(v)
+	case 2:
+		return uint16(v)
+	case 4:
+		return uint32(v)
+	default:
+		return v
+	}
+}
+
+// FloatValue converts the bits of an IEEE 754 number read from a target,
+// 4 or 8 bytes wide, into a float64
+func FloatValue(v uint64, byteWidth int) float64 {
+	if byteWidth == 4 {
+		return float64(math.Float32frombits(uint32(v)))
+	}
+	return math.Float64frombits(v)
+}
+
+// FormatDescription replaces the printf-style conversions in a rule's
+// description (%d, %u, %x, %o, %c, %s, %f...) with the value the rule read,
+// the way libmagic does. Flags, width and precision are honoured, length
+// modifiers like the "ll" in "%lld" are ignored.
+func FormatDescription(description string, value interface{}) string {
+	if !strings.Contains(description, "%") {
+		return description
+	}
+
+	var out strings.Builder
+	input := description
+	inputSize := len(input)
+
+	for i := 0; i < inputSize; i++ {
+		c := input[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+
+		start := i
+		i++
+		if i < inputSize && input[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+
+		// flags, width and precision carry over to go's fmt as-is
+		specStart := i
+		for i < inputSize && strings.IndexByte("-+ #0", input[i]) >= 0 {
+			i++
+		}
+		for i < inputSize && (input[i] >= '0' && input[i] <= '9' || input[i] == '.') {
+			i++
+		}
+		spec := input[specStart:i]
+
+		// length modifiers don't matter, values already have a size
+		for i < inputSize && strings.IndexByte("hlLqjzt", input[i]) >= 0 {
+			i++
+		}
+
+		if i >= inputSize {
+			// unfinished conversion, print it as-is
+			out.WriteString(input[start:])
+			break
+		}
+
+		formatted, ok := formatValue(spec, input[i], value)
+		if !ok {
+			out.WriteString(input[start : i+1])
+			continue
+		}
+		out.WriteString(formatted)
+	}
+
+	return out.String()
+}
+
+func formatValue(spec string, verb byte, value interface{}) (string, bool) {
+	switch verb {
+	case 'd', 'i':
+		return fmt.Sprintf("%"+spec+"d", signedValue(value)), true
+	case 'u':
+		return fmt.Sprintf("%"+spec+"d", unsignedValue(value)), true
+	case 'x', 'X', 'o':
+		return fmt.Sprintf("%"+spec+string(verb), unsignedValue(value)), true
+	case 'c':
+		// the raw byte, like C, rather than its UTF-8 encoding
+		return fmt.Sprintf("%"+spec+"s", string([]byte{byte(unsignedValue(value))})), true
+	case 's':
+		return fmt.Sprintf("%"+spec+"s", stringValue(value)), true
+	case 'f', 'F', 'e', 'E', 'g', 'G':
+		if verb == 'F' {
+			verb = 'f'
+		}
+		return fmt.Sprintf("%"+spec+string(verb), floatValue(value)), true
+	default:
+		return "", false
+	}
+}
+
+func signedValue(value interface{}) int64 {
+	switch v := value.(type) {
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+// unsignedValue reinterprets signed values as unsigned numbers of the same size,
+// so that %x of a negative short is "ffff" like in C
+func unsignedValue(value interface{}) uint64 {
+	switch v := value.(type) {
+	case int8:
+		return uint64(uint8(v))
+	case int16:
+		return uint64(uint16(v))
+	case int32:
+		return uint64(uint32(v))
+	case int64:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uint64:
+		return v
+	case float64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
+
+func floatValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case uint8, uint16, uint32, uint64:
+		return float64(unsignedValue(v))
+	default:
+		return float64(signedValue(v))
+	}
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,40 @@
+package magic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FormatDescription(t *testing.T) {
+	cases := []struct {
+		description string
+		value       interface{}
+		expected    string
+	}{
+		{"no conversions", int32(3), "no conversions"},
+		{"(signal %d),", int32(11), "(signal 11),"},
+		{"%d", int16(-2), "-2"},
+		{"%u", int16(-2), "65534"},
+		{"0x%x", int16(-2), "0xfffe"},
+		{"%#x", uint32(0x1f), "0x1f"},
+		{"%04X", uint16(0xab), "00AB"},
+		{"%o", uint8(8), "10"},
+		{"%lld architectures", uint64(3), "3 architectures"},
+		{"version %ld.%ld", uint32(4), "version 4.4"},
+		{"'%c'", uint8('A'), "'A'"},
+		{"'%c'", uint8(0xe9), "'\xe9'"},
+		{"%-3c|", int8(-1), "\xff  |"},
+		{"of '%s'", "bash", "of 'bash'"},
+		{"%.3s", "abcdef", "abc"},
+		{"%-4d|", int8(7), "7   |"},
+		{"%5.2f", 3.14159, " 3.14"},
+		{"100%%", nil, "100%"},
+		{"trailing %", int32(1), "trailing %"},
+		{"odd %y", int32(1), "odd %y"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, FormatDescription(c.description, c.value), c.description)
+	}
+}
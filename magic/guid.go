@@ -0,0 +1,56 @@
+package magic
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// guidLen is the size of a GUID, in bytes
+const guidLen = 16
+
+// ParseGUID checks a GUID written like "75B22630-668E-11CF-A6D9-00AA0062CE6C"
+// and returns it in the form ReadGUID uses
+func ParseGUID(s string) (string, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("malformed GUID %s, expected 5 groups", s)
+	}
+
+	for i, size := range []int{8, 4, 4, 4, 12} {
+		if len(parts[i]) != size {
+			return "", fmt.Errorf("malformed GUID %s, group %d should have %d digits", s, i+1, size)
+		}
+		_, err := hex.DecodeString(parts[i])
+		if err != nil {
+			return "", fmt.Errorf("malformed GUID %s: %s", s, err.Error())
+		}
+	}
+
+	return strings.ToUpper(s), nil
+}
+
+// ReadGUID reads a Microsoft GUID at the given index and returns it in its
+// usual text form, like "75B22630-668E-11CF-A6D9-00AA0062CE6C". The first
+// three groups are stored in little-endian order.
+func ReadGUID(sr *util.SliceReader, targetIndex int64) (string, bool) {
+	if targetIndex < 0 || targetIndex+guidLen > sr.Size() {
+		return "", false
+	}
+
+	b := make([]byte, guidLen)
+	n, _ := sr.ReadAt(b, targetIndex)
+	if n < guidLen {
+		return "", false
+	}
+
+	return fmt.Sprintf("%08X-%04X-%04X-%04X-%012X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16]), true
+}
@@ -0,0 +1,33 @@
+package magic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseGUID(t *testing.T) {
+	guid, err := ParseGUID("75b22630-668e-11cf-a6d9-00aa0062ce6c")
+	assert.NoError(t, err)
+	assert.Equal(t, "75B22630-668E-11CF-A6D9-00AA0062CE6C", guid)
+
+	_, err = ParseGUID("75B22630-668E-11CF-A6D900AA0062CE6C")
+	assert.Error(t, err)
+	_, err = ParseGUID("75B2263-668E-11CF-A6D9-00AA0062CE6C")
+	assert.Error(t, err)
+	_, err = ParseGUID("75B2263Z-668E-11CF-A6D9-00AA0062CE6C")
+	assert.Error(t, err)
+}
+
+func Test_ReadGUID(t *testing.T) {
+	sr := stringReader("xx\x30\x26\xb2\x75\x8e\x66\xcf\x11\xa6\xd9\x00\xaa\x00\x62\xce\x6c")
+
+	guid, ok := ReadGUID(sr, 2)
+	assert.True(t, ok)
+	assert.Equal(t, "75B22630-668E-11CF-A6D9-00AA0062CE6C", guid)
+
+	_, ok = ReadGUID(sr, 3)
+	assert.False(t, ok)
+	_, ok = ReadGUID(sr, -1)
+	assert.False(t, ok)
+}
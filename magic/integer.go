@@ -0,0 +1,67 @@
+package magic
+
+// IntegerTest describes which comparison to perform on an integer
+type IntegerTest int
+
+const (
+	// IntegerTestEqual tests that two integers have the same value
+	IntegerTestEqual IntegerTest = iota
+	// IntegerTestNotEqual tests that two integers have different values
+	IntegerTestNotEqual
+	// IntegerTestLessThan tests that one integer is less than the other
+	IntegerTestLessThan
+	// IntegerTestGreaterThan tests that one integer is greater than the other
+	IntegerTestGreaterThan
+	// IntegerTestAnd tests that all the bits in the pattern are set
+	IntegerTestAnd
+	// IntegerTestClear tests that at least one of the bits in the pattern is clear
+	IntegerTestClear
+)
+
+// IntegerBits truncates v to byteWidth bytes
+func IntegerBits(v uint64, byteWidth int) uint64 {
+	if byteWidth >= 8 {
+		return v
+	}
+	return v & (1<<(uint(byteWidth)*8) - 1)
+}
+
+// SignExtend reads the low byteWidth bytes of v as a signed integer
+func SignExtend(v uint64, byteWidth int) int64 {
+	if byteWidth >= 8 {
+		return int64(v)
+	}
+	shift := 64 - uint(byteWidth)*8
+	return int64(v<<shift) >> shift
+}
+
+// MatchInteger performs test on v, an integer byteWidth bytes wide read from
+// the target (after any mask or inversion), against value. Like libmagic,
+// both sides are cut to byteWidth bytes first, and for signed integers, also
+// sign-extended, so that "byte -1" and "byte 0xff" are the same test.
+func MatchInteger(v uint64, byteWidth int, signed bool, test IntegerTest, value int64) bool {
+	a := IntegerBits(v, byteWidth)
+	b := IntegerBits(uint64(value), byteWidth)
+
+	switch test {
+	case IntegerTestEqual:
+		return a == b
+	case IntegerTestNotEqual:
+		return a != b
+	case IntegerTestLessThan:
+		if signed {
+			return SignExtend(a, byteWidth) < SignExtend(b, byteWidth)
+		}
+		return a < b
+	case IntegerTestGreaterThan:
+		if signed {
+			return SignExtend(a, byteWidth) > SignExtend(b, byteWidth)
+		}
+		return a > b
+	case IntegerTestAnd:
+		return a&b == b
+	case IntegerTestClear:
+		return a&b != b
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package magic
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// pstringMaxLen is how many bytes of a pstring's contents are looked at,
+// like libmagic
+const pstringMaxLen = 127
+
+// PstringTest reads a Pascal string at the given index: a length prefix of
+// lengthWidth bytes, followed by the string itself. If lengthIncludesItself
+// is set, the length counts the prefix too.
+// It returns the contents of the string, how many bytes the prefix and the
+// contents span (or -1 if the string couldn't be read), and whether the
+// contents start with pattern, like StringTest.
+func PstringTest(sr *util.SliceReader, targetIndex int64, patternString string, flags StringTestFlags, lengthWidth int, byteOrder binary.ByteOrder, lengthIncludesItself bool) (string, int64, bool) {
+	if targetIndex < 0 {
+		return "", -1, false
+	}
+
+	prefix := make([]byte, lengthWidth)
+	n, _ := sr.ReadAt(prefix, targetIndex)
+	if n < lengthWidth || targetIndex+int64(lengthWidth) > sr.Size() {
+		return "", -1, false
+	}
+
+	var length int64
+	switch lengthWidth {
+	case 1:
+		length = int64(prefix[0])
+	case 2:
+		length = int64(byteOrder.Uint16(prefix))
+	case 4:
+		length = int64(byteOrder.Uint32(prefix))
+	}
+
+	if lengthIncludesItself {
+		length -= int64(lengthWidth)
+		if length < 0 {
+			return "", -1, false
+		}
+	}
+
+	contentsIndex := targetIndex + int64(lengthWidth)
+	length = min(length, pstringMaxLen, sr.Size()-contentsIndex)
+
+	contents := make([]byte, length)
+	n, _ = sr.ReadAt(contents, contentsIndex)
+	contents = contents[:n]
+	if i := bytes.IndexByte(contents, 0); i >= 0 {
+		contents = contents[:i]
+	}
+
+	span := int64(lengthWidth) + int64(len(contents))
+
+	if patternString == "" {
+		return string(contents), span, true
+	}
+
+	contentsReader := sr.Slice(contentsIndex).Cap(int64(len(contents)))
+	matched := StringTest(contentsReader, 0, patternString, flags) >= 0
+	return string(contents), span, matched
+}
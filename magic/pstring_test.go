@@ -0,0 +1,48 @@
+package magic
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/postfix/golibmagic/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func stringReader(s string) *util.SliceReader {
+	return util.NewSliceReader(strings.NewReader(s), 0, int64(len(s)))
+}
+
+func Test_PstringTest(t *testing.T) {
+	cases := []struct {
+		target      string
+		pattern     string
+		lengthWidth int
+		byteOrder   binary.ByteOrder
+		includes    bool
+		value       string
+		span        int64
+		matched     bool
+	}{
+		{"\x03foobar", "foo", 1, binary.LittleEndian, false, "foo", 4, true},
+		{"\x03foobar", "foob", 1, binary.LittleEndian, false, "foo", 4, false},
+		{"\x03FOO", "foo", 1, binary.LittleEndian, false, "FOO", 4, false},
+		{"\x00\x03foo", "", 2, binary.BigEndian, false, "foo", 5, true},
+		{"\x03\x00\x00\x00foo", "", 4, binary.LittleEndian, false, "foo", 7, true},
+		{"\x05\x00foo", "", 2, binary.LittleEndian, true, "foo", 5, true},
+		{"\x01\x00foo", "", 2, binary.LittleEndian, true, "", -1, false},
+		{"\x05fo\x00o", "", 1, binary.LittleEndian, false, "fo", 3, true},
+		{"\x09foo", "", 1, binary.LittleEndian, false, "foo", 4, true},
+		{"", "", 1, binary.LittleEndian, false, "", -1, false},
+	}
+
+	for _, c := range cases {
+		value, span, matched := PstringTest(stringReader(c.target), 0, c.pattern, 0, c.lengthWidth, c.byteOrder, c.includes)
+		assert.Equal(t, c.value, value, "%q", c.target)
+		assert.Equal(t, c.span, span, "%q", c.target)
+		assert.Equal(t, c.matched, matched, "%q", c.target)
+	}
+
+	_, _, matched := PstringTest(stringReader("\x03FOO"), 0, "foo", LowerMatchesBoth, 1, binary.LittleEndian, false)
+	assert.True(t, matched)
+}
@@ -0,0 +1,84 @@
+package magic
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// RegexTestFlags describes how to perform a regex test
+type RegexTestFlags int64
+
+const (
+	// RegexIgnoreCase ("c" flag) makes the expression case-insensitive
+	RegexIgnoreCase RegexTestFlags = 1 << iota
+	// RegexOffsetStart ("s" flag) makes relative offsets of child rules
+	// start at the beginning of the match, rather than its end
+	RegexOffsetStart
+	// RegexLineCount ("l" flag) makes the range of the test a number of
+	// lines instead of a number of bytes
+	RegexLineCount
+)
+
+// RegexMaxLen is the most bytes a regex test looks at, like libmagic
+const RegexMaxLen = 8192
+
+// regexLineLen is how many bytes a line is assumed to hold at most,
+// when the range of a regex test is a number of lines
+const regexLineLen = 80
+
+// RegexSyntax translates the expression of a regex test into go regexp
+// syntax. Like libmagic, '^' and '$' match at line boundaries and '.'
+// doesn't match newlines.
+func RegexSyntax(pattern string, flags RegexTestFlags) string {
+	if flags&RegexIgnoreCase != 0 {
+		return "(?mi)" + pattern
+	}
+	return "(?m)" + pattern
+}
+
+// RegexTest looks for re in target, starting at the given index and
+// within count bytes (or lines, with RegexLineCount), or as far as
+// RegexMaxLen if count is 0. It returns the matched text and its position
+// relative to targetIndex, or -1 if there's no match.
+func RegexTest(sr *util.SliceReader, targetIndex int64, re *regexp.Regexp, count int64, flags RegexTestFlags) (string, int64) {
+	size := sr.Size() - targetIndex
+	if targetIndex < 0 || size <= 0 {
+		return "", -1
+	}
+
+	maxLen := count
+	if flags&RegexLineCount != 0 {
+		maxLen = count * regexLineLen
+	}
+	if maxLen <= 0 || maxLen > size {
+		maxLen = size
+	}
+	if maxLen > RegexMaxLen {
+		maxLen = RegexMaxLen
+	}
+
+	buf := make([]byte, maxLen)
+	n, _ := sr.ReadAt(buf, targetIndex)
+	buf = buf[:n]
+
+	if flags&RegexLineCount != 0 && count > 0 {
+		end := 0
+		for lines := int64(0); lines < count; lines++ {
+			i := bytes.IndexByte(buf[end:], '\n')
+			if i < 0 {
+				end = len(buf)
+				break
+			}
+			end += i + 1
+		}
+		buf = buf[:end]
+	}
+
+	loc := re.FindIndex(buf)
+	if loc == nil {
+		return "", -1
+	}
+	return string(buf[loc[0]:loc[1]]), int64(loc[0])
+}
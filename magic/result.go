@@ -0,0 +1,76 @@
+package magic
+
+import "github.com/postfix/golibmagic/util"
+
+// Match describes a rule that matched while identifying a target
+type Match struct {
+	// Source is the name of the magic file the rule comes from
+	Source string
+	// Line is the line number of the rule in Source
+	Line int
+	// Level is how deeply nested the rule is, 0 for top-level rules
+	Level int
+	// Offset is where in the target the rule looked
+	Offset int64
+	// Value is what the rule read from the target, if anything
+	Value interface{}
+	// Description is the rule's description, formatted with Value
+	Description string
+
+	// Mime, Extensions and Apple are the rule's annotations, if any
+	Mime       string
+	Extensions []string
+	Apple      string
+}
+
+// Result is everything we learned about a target from a top-level
+// rule and the rules nested under it
+type Result struct {
+	// Description is what file(1) would print
+	Description string
+	// Mime is the MIME type of the first match that had one
+	Mime string
+	// Extensions lists the usual file extensions given by all matches
+	Extensions []string
+	// Apple holds classic Mac OS creator and type codes, if any match had them
+	Apple string
+	// Strength is the strength of the top-level rule
+	Strength int
+	// Matches lists the rules that matched, in order
+	Matches []Match
+
+	descriptions []string
+}
+
+// Add records a match and merges what it reported into the result
+func (r *Result) Add(m Match) {
+	r.Matches = append(r.Matches, m)
+
+	if m.Description != "" {
+		r.descriptions = append(r.descriptions, m.Description)
+		r.Description = util.MergeStrings(r.descriptions)
+	}
+	if r.Mime == "" {
+		r.Mime = m.Mime
+	}
+	if r.Apple == "" {
+		r.Apple = m.Apple
+	}
+	for _, ext := range m.Extensions {
+		if !util.ContainsString(r.Extensions, ext) {
+			r.Extensions = append(r.Extensions, ext)
+		}
+	}
+}
+
+// MaxIndirectDepth is how many indirect rules can be nested, like libmagic
+const MaxIndirectDepth = 50
+
+// Include adds the matches of a result found at the given offset, as
+// indirect rules do, shifting their offsets accordingly
+func (r *Result) Include(nested *Result, offset int64) {
+	for _, m := range nested.Matches {
+		m.Offset += offset
+		r.Add(m)
+	}
+}
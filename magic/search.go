@@ -2,10 +2,41 @@ package magic
 
 import "github.com/postfix/golibmagic/util"
 
-// SearchTest looks for a fixed pattern at any position within a certain length
-func SearchTest(sr *util.SliceReader, targetIndex int64, maxLen int64, pattern string) int64 {
-	sf := MakeStringFinder(pattern)
+// searchMatchFlags are the string test flags that change what a search matches,
+// which rules out Boyer-Moore
+const searchMatchFlags = CompactWhitespace | OptionalBlanks | LowerMatchesBoth | UpperMatchesBoth | FullWord
 
-	sr = sr.Slice(targetIndex).Cap(maxLen)
-	return sf.next(sr)
+// SearchTest looks for a pattern at any of the first maxLen positions of the
+// target, starting at given index, honoring the same flags as StringTest.
+// It returns where the match starts, relative to targetIndex, and how many
+// bytes of the target it spans, or -1 and 0 if there's no match.
+func SearchTest(sr *util.SliceReader, targetIndex int64, maxLen int64, pattern string, flags StringTestFlags) (int64, int64) {
+	if targetIndex < 0 || targetIndex > sr.Size() {
+		return -1, 0
+	}
+
+	if flags&searchMatchFlags == 0 {
+		sf := MakeStringFinder(pattern)
+
+		// the match may end past the range, as long as it starts within it
+		pos := sf.next(sr.Slice(targetIndex).Cap(maxLen + int64(len(pattern)) - 1))
+		if pos < 0 {
+			return -1, 0
+		}
+		return pos, int64(len(pattern))
+	}
+
+	bv := &util.ByteView{
+		Input:    sr,
+		LookBack: 0,
+	}
+	patternBytes := []byte(pattern)
+
+	for pos := int64(0); pos < maxLen && targetIndex+pos < sr.Size(); pos++ {
+		matchLen := stringMatch(bv, targetIndex+pos, patternBytes, flags)
+		if matchLen >= 0 {
+			return pos, matchLen
+		}
+	}
+	return -1, 0
 }
@@ -1,6 +1,9 @@
 package magic
 
 import (
+	"bytes"
+	"unicode/utf8"
+
 	"github.com/postfix/golibmagic/util"
 )
 
@@ -8,10 +11,12 @@ import (
 type StringTestFlags int64
 
 const (
-	// CompactWhitespace ("W" flag) compacts whitespace in the target,
-	// which must contain at least one whitespace character
+	// CompactWhitespace ("W" flag) makes a blank in the magic match one or
+	// more whitespace characters in the target. The target must contain at
+	// least as many consecutive whitespace characters as the magic has blanks.
 	CompactWhitespace = 1 << iota
-	// OptionalBlanks ("w" flag) treats every blank in the magic as an optional blank
+	// OptionalBlanks ("w" flag) makes a blank in the magic match zero or more
+	// whitespace characters in the target
 	OptionalBlanks
 	// LowerMatchesBoth ("c" flag) specifies case-insensitive matching: lower case
 	// characters in the magic match both lower and upper case characters
@@ -25,66 +30,167 @@ const (
 	ForceText
 	// ForceBinary ("b" flag) forces the test to be done for binary files
 	ForceBinary
+	// Trim ("T" flag) trims leading and trailing whitespace from the
+	// string printed by the rule
+	Trim
+	// FullWord ("f" flag) only matches if the target has whitespace or
+	// nothing right after the match
+	FullWord
 )
 
-// StringTest looks for a string pattern in target, at given index
+// stringMaxLen is how much of the target string rules print, at most
+const stringMaxLen = 127
+
+// isSpace tests if a byte is whitespace, like C's isspace
+func isSpace(b byte) bool {
+	return b == ' ' || (b >= '\t' && b <= '\r')
+}
+
+// StringReader returns where a string rule limited to maxLen bytes of the
+// target (if non-zero) should look, as a reader and an index into it
+func StringReader(sr *util.SliceReader, targetIndex int64, maxLen int64) (*util.SliceReader, int64) {
+	if maxLen <= 0 || targetIndex < 0 || targetIndex > sr.Size() {
+		return sr, targetIndex
+	}
+	return sr.Slice(targetIndex).Cap(maxLen), 0
+}
+
+// StringTest looks for a string pattern in target, at given index. It returns
+// how many bytes of the target matched, which may differ from the length of the
+// pattern when whitespace flags are set, or -1 if the target doesn't match.
 func StringTest(sr *util.SliceReader, targetIndex int64, patternString string, flags StringTestFlags) int64 {
+	if targetIndex < 0 {
+		return -1
+	}
+
 	bv := &util.ByteView{
 		Input:    sr,
 		LookBack: 0,
 	}
+	return stringMatch(bv, targetIndex, []byte(patternString), flags)
+}
+
+// stringMatch is StringTest over a ByteView, so searches can reuse it
+func stringMatch(bv *util.ByteView, targetIndex int64, pattern []byte, flags StringTestFlags) int64 {
+	skipWhitespace := func(i int64) int64 {
+		for {
+			targetInt := bv.Get(i)
+			if targetInt < 0 || !isSpace(byte(targetInt)) {
+				return i
+			}
+			i++
+		}
+	}
 
-	pattern := []byte(patternString)
-	patternSize := len(pattern)
 	patternIndex := 0
+	i := targetIndex
 
-	for {
+	for patternIndex < len(pattern) {
 		patternByte := pattern[patternIndex]
-		targetInt := bv.Get(targetIndex)
-		if targetInt == -1 {
+
+		if flags&CompactWhitespace > 0 && isSpace(patternByte) {
+			patternIndex++
+			targetInt := bv.Get(i)
+			if targetInt < 0 || !isSpace(byte(targetInt)) {
+				return -1
+			}
+			i++
+			// runs of blanks in the magic match runs at least as long
+			if patternIndex >= len(pattern) || !isSpace(pattern[patternIndex]) {
+				i = skipWhitespace(i)
+			}
+			continue
+		}
+
+		if flags&OptionalBlanks > 0 && isSpace(patternByte) {
+			patternIndex++
+			i = skipWhitespace(i)
+			continue
+		}
+
+		targetInt := bv.Get(i)
+		if targetInt < 0 {
 			return -1
 		}
 		targetByte := byte(targetInt)
 
-		matches := patternByte == targetByte
-		if matches {
-			// perfect match, advance both
-			targetIndex++
-			patternIndex++
-		} else if flags&OptionalBlanks > 0 && util.IsWhitespace(patternByte) {
-			// cool, it's optional then
-			patternIndex++
-		} else if flags&LowerMatchesBoth > 0 && util.IsLowerLetter(patternByte) && util.ToLower(targetByte) == patternByte {
-			// case insensitive match
-			targetIndex++
-			patternIndex++
-		} else if flags&UpperMatchesBoth > 0 && util.IsUpperLetter(patternByte) && util.ToUpper(targetByte) == patternByte {
-			// case insensitive match
-			targetIndex++
-			patternIndex++
-		} else {
-			// not a match
+		if flags&LowerMatchesBoth > 0 && util.IsLowerLetter(patternByte) {
+			targetByte = util.ToLower(targetByte)
+		} else if flags&UpperMatchesBoth > 0 && util.IsUpperLetter(patternByte) {
+			targetByte = util.ToUpper(targetByte)
+		}
+
+		if targetByte != patternByte {
 			return -1
 		}
+		i++
+		patternIndex++
+	}
 
-		if flags&CompactWhitespace > 0 && util.IsWhitespace(targetByte) {
-			// if we had whitespace, skip any whitespace coming after it
-			for {
-				targetIndex++
-				targetInt = bv.Get(targetIndex)
-				if targetInt == -1 {
-					return -1
-				}
-				targetByte = byte(targetInt)
-				if !util.IsWhitespace(targetByte) {
-					break
-				}
-			}
+	if flags&FullWord > 0 {
+		targetInt := bv.Get(i)
+		if targetInt > 0 && !isSpace(byte(targetInt)) {
+			return -1
+		}
+	}
+
+	return i - targetIndex
+}
+
+// StringCompare compares the target at given index with pattern, byte by
+// byte over the length of the pattern, like libmagic does for "<" and ">"
+// string tests. It returns the difference between the first pair of bytes
+// that differ (target minus pattern), or 0. Bytes past the end of the target
+// read as NUL. The case-insensitive flags are honored.
+func StringCompare(sr *util.SliceReader, targetIndex int64, pattern string, flags StringTestFlags) int {
+	target := make([]byte, len(pattern))
+	if targetIndex >= 0 && targetIndex < sr.Size() {
+		sr.ReadAt(target[:min(int64(len(target)), sr.Size()-targetIndex)], targetIndex)
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		patternByte := pattern[i]
+		targetByte := target[i]
+
+		if flags&LowerMatchesBoth > 0 && util.IsLowerLetter(patternByte) {
+			targetByte = util.ToLower(targetByte)
+		} else if flags&UpperMatchesBoth > 0 && util.IsUpperLetter(patternByte) {
+			targetByte = util.ToUpper(targetByte)
 		}
 
-		if patternIndex >= patternSize {
-			// hey it matched all the way!
-			return targetIndex
+		if targetByte != patternByte {
+			return int(targetByte) - int(patternByte)
+		}
+	}
+	return 0
+}
+
+// StringValue reads the string at given index, as string rules that don't
+// test for equality print it: up to the first NUL, or also the first line
+// break if cutAtNewline is set, at most 127 bytes, and trimmed if the Trim
+// flag is set. It also returns how many bytes of the target that spans,
+// before trimming, or -1 if the index is out of the target.
+func StringValue(sr *util.SliceReader, targetIndex int64, flags StringTestFlags, cutAtNewline bool) (string, int64) {
+	if targetIndex < 0 || targetIndex >= sr.Size() {
+		return "", -1
+	}
+
+	buf := make([]byte, min(stringMaxLen, sr.Size()-targetIndex))
+	n, _ := sr.ReadAt(buf, targetIndex)
+	buf = buf[:n]
+
+	for i, c := range buf {
+		if c == 0 || (cutAtNewline && (c == '\r' || c == '\n')) {
+			buf = buf[:i]
+			break
 		}
 	}
+
+	span := int64(len(buf))
+	if flags&Trim > 0 {
+		buf = bytes.TrimFunc(buf, func(r rune) bool {
+			return r < utf8.RuneSelf && isSpace(byte(r))
+		})
+	}
+	return string(buf), span
 }
@@ -0,0 +1,65 @@
+package magic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// string16MaxLen is how many 16-bit units of a target a 16-bit string
+// test looks at, at most
+const string16MaxLen = 256
+
+// String16Test looks for a string pattern in UTF-16 target data, at the
+// given index. Like libmagic, each character of the pattern is compared
+// with the low byte of a 16-bit unit, so only latin-1 patterns make sense.
+// It returns the target string transcoded to UTF-8, up to the first NUL,
+// and the index right after the match (or -1 if it didn't match).
+// An empty pattern matches any string, and then the index is right after it.
+func String16Test(sr *util.SliceReader, targetIndex int64, patternString string, flags StringTestFlags, byteOrder binary.ByteOrder) (string, int64) {
+	if targetIndex < 0 {
+		return "", -1
+	}
+
+	buf := make([]byte, min(sr.Size()-targetIndex, 2*string16MaxLen))
+	if len(buf) < 2 {
+		return "", -1
+	}
+	n, _ := sr.ReadAt(buf, targetIndex)
+
+	units := make([]uint16, n/2)
+	for i := range units {
+		units[i] = byteOrder.Uint16(buf[2*i:])
+	}
+
+	lowBytes := make([]byte, len(units))
+	for i, unit := range units {
+		lowBytes[i] = byte(unit)
+		if lowBytes[i] == 0 && unit != 0 {
+			// don't let non-latin characters end the string
+			lowBytes[i] = ' '
+		}
+	}
+
+	value := units
+	for i, unit := range units {
+		if unit == 0 {
+			value = units[:i]
+			break
+		}
+	}
+	text := string(utf16.Decode(value))
+
+	if patternString == "" {
+		return text, targetIndex + 2*int64(len(value))
+	}
+
+	lowReader := util.NewSliceReader(bytes.NewReader(lowBytes), 0, int64(len(lowBytes)))
+	matchEnd := StringTest(lowReader, 0, patternString, flags)
+	if matchEnd < 0 {
+		return text, -1
+	}
+	return text, targetIndex + 2*matchEnd
+}
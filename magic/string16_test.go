@@ -0,0 +1,38 @@
+package magic
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_String16Test(t *testing.T) {
+	cases := []struct {
+		target    string
+		pattern   string
+		flags     StringTestFlags
+		byteOrder binary.ByteOrder
+		text      string
+		matchEnd  int64
+	}{
+		{"h\x00i\x00\x00\x00", "hi", 0, binary.LittleEndian, "hi", 4},
+		{"\x00h\x00i", "hi", 0, binary.BigEndian, "hi", 4},
+		{"h\x00i\x00", "ho", 0, binary.LittleEndian, "hi", -1},
+		{"H\x00I\x00", "hi", LowerMatchesBoth, binary.LittleEndian, "HI", 4},
+		// non-latin characters whose low byte is 0 don't end the string
+		{"a\x00\x00\x01b\x00", "a b", 0, binary.LittleEndian, "a\u0100b", 6},
+		{"h\x00i\x00\x00\x00x\x00", "", 0, binary.LittleEndian, "hi", 4},
+		{"h", "", 0, binary.LittleEndian, "", -1},
+	}
+
+	for _, c := range cases {
+		text, matchEnd := String16Test(stringReader(c.target), 0, c.pattern, c.flags, c.byteOrder)
+		assert.Equal(t, c.text, text, "%q in %q", c.pattern, c.target)
+		assert.Equal(t, c.matchEnd, matchEnd, "%q in %q", c.pattern, c.target)
+	}
+
+	// the index isn't relative
+	_, matchEnd := String16Test(stringReader("..h\x00i\x00"), 2, "hi", 0, binary.LittleEndian)
+	assert.EqualValues(t, 6, matchEnd)
+}
@@ -0,0 +1,85 @@
+package magic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StringTest(t *testing.T) {
+	cases := []struct {
+		target   string
+		pattern  string
+		flags    StringTestFlags
+		expected int64
+	}{
+		{"hello world", "hello", 0, 5},
+		{"hello world", "help", 0, -1},
+		{"hel", "hello", 0, -1},
+		{"HeLLo", "hello", LowerMatchesBoth, 5},
+		{"hello", "HELLO", LowerMatchesBoth, -1},
+		{"hello", "HELLO", UpperMatchesBoth, 5},
+		{"ab  \t cd", "ab cd", CompactWhitespace, 8},
+		{"abcd", "ab cd", CompactWhitespace, -1},
+		{"ab cd", "ab  cd", CompactWhitespace, -1},
+		{"ab  cd", "ab  cd", CompactWhitespace, 6},
+		{"abcd", "ab cd", OptionalBlanks, 4},
+		{"ab \n cd", "ab cd", OptionalBlanks, 7},
+		{"ab  CD", "ab cd", OptionalBlanks | LowerMatchesBoth, 6},
+		{"word", "word", FullWord, 4},
+		{"word wide", "word", FullWord, 4},
+		{"wordy", "word", FullWord, -1},
+		{"word\x00", "word", FullWord, 4},
+		{"", "", 0, 0},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, StringTest(stringReader(c.target), 0, c.pattern, c.flags), "%q in %q", c.pattern, c.target)
+	}
+
+	// the result is a length, not an index
+	assert.EqualValues(t, 3, StringTest(stringReader("xxabc"), 2, "abc", 0))
+}
+
+func Test_StringCompare(t *testing.T) {
+	assert.Positive(t, StringCompare(stringReader("abc"), 0, "\x00", 0))
+	assert.Zero(t, StringCompare(stringReader("\x00"), 0, "\x00", 0))
+	assert.Zero(t, StringCompare(stringReader(""), 0, "\x00", 0))
+	assert.Negative(t, StringCompare(stringReader("abc"), 0, "abd", 0))
+	assert.Positive(t, StringCompare(stringReader("abc"), 0, "ABC", 0))
+	assert.Zero(t, StringCompare(stringReader("ABC"), 0, "abc", LowerMatchesBoth))
+}
+
+func Test_StringValue(t *testing.T) {
+	cases := []struct {
+		target       string
+		flags        StringTestFlags
+		cutAtNewline bool
+		value        string
+		span         int64
+	}{
+		{"name\x00rest", 0, false, "name", 4},
+		{"two\nlines", 0, false, "two\nlines", 9},
+		{"two\r\nlines", 0, true, "two", 3},
+		{"  padded  \x00", Trim, false, "padded", 10},
+		{"  padded  \x00", 0, false, "  padded  ", 10},
+		{strings.Repeat("a", 200), 0, false, strings.Repeat("a", 127), 127},
+	}
+
+	for _, c := range cases {
+		value, span := StringValue(stringReader(c.target), 0, c.flags, c.cutAtNewline)
+		assert.Equal(t, c.value, value, "%q", c.target)
+		assert.Equal(t, c.span, span, "%q", c.target)
+	}
+
+	_, span := StringValue(stringReader("abc"), 3, 0, false)
+	assert.EqualValues(t, -1, span)
+
+	// limited to a few bytes of the target
+	sr, index := StringReader(stringReader("xxabcdef"), 2, 3)
+	value, span := StringValue(sr, index, 0, false)
+	assert.Equal(t, "abc", value)
+	assert.EqualValues(t, 3, span)
+	assert.EqualValues(t, -1, StringTest(sr, index, "abcd", 0))
+}
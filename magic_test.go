@@ -0,0 +1,512 @@
+package golibmagic
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/postfix/golibmagic/magic"
+	"github.com/postfix/golibmagic/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookup identifies data with a magic database made of a single file of rules
+func lookup(t *testing.T, rules string, data []byte, opts ...Option) string {
+	t.Helper()
+
+	magdir := fstest.MapFS{
+		"test": &fstest.MapFile{
+			Data: []byte(rules),
+		},
+	}
+
+	m, err := New(append([]Option{WithMagdirFS(magdir)}, opts...)...)
+	require.NoError(t, err)
+	defer m.Close()
+
+	res, err := m.Lookup(data)
+	require.NoError(t, err)
+	return res
+}
+
+func Test_Lookup(t *testing.T) {
+	m, err := New()
+	assert.NoError(t, err)
+
+	elfHeader := []byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	res, err := m.Lookup(elfHeader)
+	assert.NoError(t, err)
+	assert.Contains(t, res, "ELF 64-bit LSB")
+
+	assert.NoError(t, m.Close())
+
+	_, err = m.Lookup(elfHeader)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func Test_LookupMagdir(t *testing.T) {
+	_, err := New(WithMagdir("does-not-exist"))
+	assert.Error(t, err)
+
+	m, err := New(WithMagdir("Magdir"))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	res, err := m.Lookup([]byte("\xca\xfe\xba\xbe\x00\x00\x00\x01"))
+	assert.NoError(t, err)
+	assert.Contains(t, res, "Mach-O universal binary")
+}
+
+func Test_StrictParsing(t *testing.T) {
+	magdir := fstest.MapFS{
+		"test": &fstest.MapFile{
+			Data: []byte("0\tstring\tGIF8\tGIF image data\n" +
+				"0\tbelong\tnope\tbroken\n" +
+				"0\tbogus\t1.0\tunsupported\n" +
+				"0\tbyte/0\tx\tdivided\n" +
+				"0\tbyte\tx\tbyte\n" +
+				">(1.b/0)\tbyte\tx\t\\b, divided\n"),
+		},
+	}
+
+	m, err := New(WithMagdirFS(magdir))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	_, err = New(WithMagdirFS(magdir), WithStrictParsing())
+	var parseErrors parser.ParseErrors
+	assert.True(t, errors.As(err, &parseErrors))
+	assert.Len(t, parseErrors, 4)
+	assert.Equal(t, "test:2:10: couldn't parse integer value \"nope\"", parseErrors[0].Error())
+	assert.Equal(t, "test:3:3: unsupported kind \"bogus\"", parseErrors[1].Error())
+	assert.Equal(t, "test:4:8: integer adjustment divides by zero", parseErrors[2].Error())
+	assert.Equal(t, "test:6:7: indirect offset adjustment divides by zero", parseErrors[3].Error())
+
+	// rules dividing by zero are skipped
+	res, err := m.Lookup([]byte("\x05\x00"))
+	assert.NoError(t, err)
+	assert.Equal(t, "byte", res)
+
+	// and so are indirect offsets divided by a zero from the target
+	checkLookups(t, []lookupCase{
+		{"0\tbyte\tx\tbyte\n>(0.b/(1))\tbyte\tx\t\\b, divided\n", "\x01\x00", "byte"},
+	})
+}
+
+func Test_LookupMime(t *testing.T) {
+	m, err := New(WithFlags(MimeType))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	res, err := m.Lookup([]byte("#!/bin/sh\necho hi\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text/x-shellscript", res)
+
+	m, err = New(WithFlags(Mime))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	res, err = m.Lookup([]byte("hello world\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=us-ascii", res)
+
+	res, err = m.Lookup([]byte("caf\xe9 au lait\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=iso-8859-1", res)
+
+	res, err = m.Lookup([]byte{0x00, 0x01, 0x02, 0xff})
+	assert.NoError(t, err)
+	assert.Equal(t, "application/octet-stream; charset=binary", res)
+}
+
+func Test_LookupExtension(t *testing.T) {
+	rules := "0\tstring\tGIF8\tGIF image data\n!:mime\timage/gif\n!:ext\tgif\n" +
+		"0\tstring\t\\xff\\xd8\\xff\tJPEG image data\n!:ext\tjpeg/jpg/jpe\n"
+
+	assert.Equal(t, "jpeg/jpg/jpe", lookup(t, rules, []byte("\xff\xd8\xff\xe0"), WithFlags(Extension)))
+	assert.Equal(t, "???", lookup(t, rules, []byte("nothing to see"), WithFlags(Extension)))
+}
+
+func Test_LookupApple(t *testing.T) {
+	rules := "0\tstring\t\\xff\\xd8\\xff\tJPEG image data\n!:apple\t8BIMJPEG\n"
+
+	assert.Equal(t, "8BIMJPEG", lookup(t, rules, []byte("\xff\xd8\xff\xe0"), WithFlags(Apple)))
+	assert.Equal(t, "UNKNUNKN", lookup(t, rules, []byte("nothing to see"), WithFlags(Apple)))
+}
+
+func Test_List(t *testing.T) {
+	magdir := fstest.MapFS{
+		"test": &fstest.MapFile{
+			Data: []byte("0\tbyte\tx\tanything\n" +
+				"0\tstring\tGIF8\tGIF image data\n>4\tbyte\t0x39\tversion 89a\n" +
+				"0\tbelong\t0x7f454c46\tELF\n!:strength - 5\n"),
+		},
+	}
+
+	m, err := New(WithMagdirFS(magdir))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, m.List(buf))
+	assert.Equal(t, "Strength =  70 : GIF image data []\n"+
+		"Strength =  65 : ELF []\n"+
+		"Strength =   1 : anything []\n", buf.String())
+}
+
+func Test_LookupKeepGoing(t *testing.T) {
+	rules := "0\tstring\tGIF8\tGIF image data\n>4\tbyte\t0x39\t\\b, version 89a\n" +
+		"0\tstring\tGIF\tgeneric GIF\n" +
+		"0\tbyte\tx\tanything\n"
+	gif := []byte("GIF89a")
+
+	assert.Equal(t, "GIF image data, version 89a", lookup(t, rules, gif))
+	assert.Equal(t, "GIF image data, version 89a\n- generic GIF\n- anything", lookup(t, rules, gif, WithFlags(KeepGoing)))
+}
+
+func Test_LookupUse(t *testing.T) {
+	rules := "0\tname\tnum\n" +
+		">0\tleshort\t0x0102\tle 0x0102\n" +
+		">(4.s+(4))\tbyte\tx\t\\b, at %d\n" +
+		"0\tname\tnothing\n" +
+		">0\tbyte\t0xff\tnever\n" +
+		"0\tstring\tLE\n" +
+		">2\tuse\tnum\n" +
+		"0\tstring\tBE\n" +
+		">2\tuse\t\\^num\n" +
+		"0\tstring\tUSE\tuser\n" +
+		">3\tuse\tnothing\n" +
+		">3\tdefault\tx\t\\b, default ran\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "LE\x02\x01\x02\x00xx\x03\x00", "le 0x0102, at 0"},
+		// a swapped page reads integers and indirect offsets the other way around
+		{rules, "BE\x01\x02\x00\x02xx\x00\x03", "le 0x0102, at 2"},
+		// use rules count as matches, even if the page didn't print anything
+		{rules, "USE\x00", "user"},
+	})
+}
+
+func Test_LookupDefault(t *testing.T) {
+	rules := "0\tstring\tD\td\n" +
+		">1\tbyte\t1\t\\b, one\n" +
+		">>2\tbyte\t9\t\\b, nine\n" +
+		">>2\tdefault\tx\t\\b, not nine\n" +
+		">1\tbyte\tx\n" +
+		">>2\tdefault\tx\t\\b, fresh default\n"
+
+	checkLookups(t, []lookupCase{
+		// each parent gives its children's default rules a fresh start
+		{rules, "D\x01\x09", "d, one, nine, fresh default"},
+		{rules, "D\x01\x08", "d, one, not nine, fresh default"},
+	})
+}
+
+func Test_LookupRelative(t *testing.T) {
+	rules := "0\tstring\tA\tA\n" +
+		">&0\tbyte\t>0\t\\b, first %d\n" +
+		">>&0\tbyte\tx\t\\b, child %d\n" +
+		">&0\tbyte\t>0\t\\b, second %d\n" +
+		"0\tstring\tB\tB\n" +
+		">1\tbyte\t2\t\\b, two\n" +
+		">>2\tbyte\t3\t\\b, three\n" +
+		">1\tbyte\tx\t\\b, then %d\n" +
+		"0\tstring\tI\tI\n" +
+		">(1.b)\tbyte\t2\t\\b, two\n" +
+		">>(2.b)\tbyte\tx\t\\b, inner %d\n" +
+		">(1.b)\tbyte\tx\t\\b, then %d\n"
+
+	checkLookups(t, []lookupCase{
+		// & is relative to the parent's match, siblings don't move it
+		{rules, "A\x01\x05", "A, first 1, child 5, second 1"},
+		// siblings reading the same place can't rely on each other's
+		// reads once children ran
+		{rules, "B\x02\x03", "B, two, three, then 2"},
+		{rules, "I\x03\x00\x02", "I, two, inner 73, then 2"},
+	})
+}
+
+func Test_LookupRegex(t *testing.T) {
+	rules := "0\tregex/1l\t^#!.*python\tPython script\n" +
+		"0\tregex/c\t^config\tconfig file\n" +
+		">&1\tregex\t[0-9.]+\t\\b, version %s\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "#!/usr/bin/env python3\nprint()\n", "Python script"},
+		// only the first line is looked at
+		{rules, "\n#!/usr/bin/env python3\n", ""},
+		{rules, "CONFIG v1.2.3\n", "config file, version 1.2.3"},
+	})
+
+	// the longest match at the leftmost position wins, like with POSIX regexec
+	rules = "0\tregex\ta|ab\tmatched %s\n" +
+		">&0\tstring\tc\t\\b, then c\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "abc", "matched ab, then c"},
+	})
+}
+
+func Test_LookupPstring(t *testing.T) {
+	rules := "0\tstring\tPS\n" +
+		">2\tpstring/hJ\tfoo\tfoo archive\n" +
+		">>&0\tpstring\tx\tnamed %s\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "PS\x08\x00foobar\x04test", "foo archive named test"},
+		// with J, the length counts itself
+		{rules, "PS\x03\x00foo", ""},
+	})
+}
+
+func Test_LookupDate(t *testing.T) {
+	rules := "0\tstring\tDT\n" +
+		">2\tbedate\tx\tcreated %s\n" +
+		">6\tleldate\t>0\t\\b, modified %s\n" +
+		">10\tmedate\tx\t\\b, archived %s\n"
+	data := "DT\x3b\x9a\xca\x00\xd2\x02\x96\x49\x5e\x5f\x00\x10"
+
+	checkLookups(t, []lookupCase{
+		{rules, data, "created Sun Sep  9 01:46:40 2001, modified Fri Feb 13 23:31:30 2009, archived Sun Sep 13 12:26:40 2020"},
+	})
+
+	// only local dates move with the time zone
+	assert.Equal(t, "created Sun Sep  9 01:46:40 2001, modified Sat Feb 14 00:31:30 2009, archived Sun Sep 13 12:26:40 2020",
+		lookup(t, rules, []byte(data), WithLocation(time.FixedZone("test", 3600))))
+}
+
+func Test_LookupFloat(t *testing.T) {
+	rules := "0\tstring\tFL\n" +
+		">2\tbefloat\t>1.5\tscale %.2f\n" +
+		">6\tledouble\tx\t\\b, offset %g\n" +
+		">6\tledouble\t<-1\t\\b, below -1\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "FL\x40\x10\x00\x00\x00\x00\x00\x00\x00\x00\xf8\xbf", "scale 2.25, offset -1.5, below -1"},
+		{rules, "FL\x40\x10\x00\x00\x00\x00\x00\x00\x00\x00\xe0\xbf", "scale 2.25, offset -0.5"},
+		{rules, "FL\x3f\x80\x00\x00", ""},
+	})
+}
+
+func Test_LookupString16(t *testing.T) {
+	rules := "0\tlestring16\tHello\tgreeting \"%s\"\n" +
+		"0\tbestring16/c\tbye\tfarewell\n" +
+		"0\tstring\tN16\tnamed\n" +
+		">3\tlestring16\tx\t%s\n" +
+		">>&0\tleshort\t0\t\\b, terminated\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "H\x00e\x00l\x00l\x00o\x00 \x00\xac\x20\x00\x00", "greeting \"Hello \u20ac\""},
+		{rules, "\x00B\x00Y\x00E", "farewell"},
+		{rules, "N16h\x00i\x00\x00\x00", "named hi, terminated"},
+	})
+}
+
+func Test_LookupIndirect(t *testing.T) {
+	rules := "0\tstring\tOUTER\touter\n" +
+		">(8.l)\tindirect\tx\t\\b, containing\n" +
+		"0\tstring\tINNER\tinner file\n" +
+		">5\tbyte\tx\tversion %d\n" +
+		"0\tstring\tLOOP\tloop\n" +
+		">0\tindirect\tx\t\\b, again\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "OUTER\x00\x00\x00\x10\x00\x00\x00\x00\x00\x00\x00INNER\x07", "outer, containing inner file version 7"},
+		// identifying again at offset 0 would never end
+		{rules, "LOOP", "loop"},
+	})
+}
+
+func Test_LookupOffsetGUID(t *testing.T) {
+	rules := "0\tstring\tHDR\n" +
+		">3\tguid\t75B22630-668E-11CF-A6D9-00AA0062CE6C\tASF\n" +
+		">>&0\tguid\tx\t\\b, stream %s\n" +
+		">>>&0\toffset\tx\t\\b, data at %lld\n" +
+		">>>&0\toffset\t<-1\t\\b, never\n"
+	data := "HDR" +
+		"\x30\x26\xb2\x75\x8e\x66\xcf\x11\xa6\xd9\x00\xaa\x00\x62\xce\x6c" +
+		"\x78\x56\x34\x12\xbc\x9a\xf0\xde\x12\x34\x56\x78\x9a\xbc\xde\xf0"
+
+	checkLookups(t, []lookupCase{
+		{rules, data, "ASF, stream 12345678-9ABC-DEF0-1234-56789ABCDEF0, data at 35"},
+	})
+}
+
+func Test_LookupMiddleEndian(t *testing.T) {
+	rules := "0\tstring\tPDP\tPDP file\n" +
+		">3\tmelong\t0x12345678\t\\b, magic ok\n" +
+		">>(7.m)\tumelong\tx\t\\b, value 0x%x\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "PDP\x34\x12\x78\x56\x00\x00\x0b\x00\xcd\xab\x02\x01", "PDP file, magic ok, value 0xabcd0102"},
+	})
+}
+
+func Test_LookupID3(t *testing.T) {
+	rules := "0\tstring\tID3\tAudio file with ID3 version 2\n" +
+		">6\tbeid3\tx\t\\b, tag size %d\n" +
+		">(6.I+10)\tbeshort&0xffe0\t0xffe0\t\\b, MPEG frame after tag\n"
+	data := "ID3\x03\x00\x00\x00\x00\x01\x01" + strings.Repeat("\x00", 129) + "\xff\xfb\x90\x00"
+
+	checkLookups(t, []lookupCase{
+		{rules, data, "Audio file with ID3 version 2, tag size 129, MPEG frame after tag"},
+	})
+}
+
+func Test_IntegerTests(t *testing.T) {
+	cases := []struct {
+		kind  string
+		test  string
+		data  string
+		match bool
+	}{
+		{"byte", "x", "\x00", true},
+		{"byte", "0x81", "\x81", true},
+		{"byte", "-127", "\x81", true},
+		{"ubyte", "-127", "\x81", true},
+		{"byte", "=0x80", "\x81", false},
+		{"byte", "!0x80", "\x81", true},
+		{"byte", "!0x81", "\x81", false},
+		{"byte", "<0", "\x81", true},
+		{"ubyte", "<0x80", "\x81", false},
+		{"byte", "<0x80", "\x00", false},
+		{"byte", ">0x80", "\x81", true},
+		{"ubyte", ">0x80", "\x81", true},
+		{"ubyte", ">0x81", "\x81", false},
+		{"byte", "&0x81", "\x83", true},
+		{"byte", "&0x84", "\x83", false},
+		{"byte", "&=0x03", "\x83", true},
+		{"byte", "^0x84", "\x83", true},
+		{"byte", "^0x81", "\x83", false},
+		{"byte", "~0x7c", "\x83", true},
+		{"byte", "~&0x04", "\x83", false},
+		{"byte", "~&0x80", "\x83", false},
+		{"byte", "~&0x7c", "\x83", true},
+		{"byte", "~^0x04", "\x83", true},
+		{"byte", "~!0x7c", "\x83", false},
+		{"ubyte", "~<0x70", "\x83", true},
+		{"byte~", "0x7c", "\x83", true},
+		{"byte~", "&0x04", "\x83", true},
+		{"ubyte~", "<0x7d", "\x83", true},
+		{"byte~&0x0f", "0xfc", "\x83", true},
+		{"byte&0x0f", "3", "\x83", true},
+		{"byte|0x0f", "0x8f", "\x83", true},
+		{"byte^0x0f", "0x8c", "\x83", true},
+		{"byte+1", "0x84", "\x83", true},
+		{"leshort", "0x0201", "\x01\x02", true},
+		{"beshort", "<0", "\x80\x00", true},
+		{"ubeshort", ">0x7fff", "\x80\x00", true},
+		{"lelong", "-2", "\xfe\xff\xff\xff", true},
+		{"ulelong", "0xfffffffe", "\xfe\xff\xff\xff", true},
+		{"lequad", "<0", "\x00\x00\x00\x00\x00\x00\x00\x80", true},
+		{"ulequad", "&0x8000000000000000", "\x00\x00\x00\x00\x00\x00\x00\x80", true},
+	}
+
+	var lookups []lookupCase
+	for _, c := range cases {
+		expected := ""
+		if c.match {
+			expected = "match"
+		}
+		lookups = append(lookups, lookupCase{
+			rules:    "0\t" + c.kind + "\t" + c.test + "\tmatch\n",
+			data:     c.data,
+			expected: expected,
+		})
+	}
+
+	// ~ in front of the value leaves the target value alone
+	lookups = append(lookups,
+		lookupCase{"0\tubyte\t~0x7c\tvalue %d\n", "\x83", "value 131"},
+		lookupCase{"0\tubyte~\tx\tinverted %d\n", "\x83", "inverted 124"},
+	)
+
+	// x next to = tests matches whatever the others did
+	anyRules := "0\tstring\tA\tA\n" +
+		">1\tbyte\t1\t\\b, one\n" +
+		">1\tbyte\tx\t\\b, then %d\n"
+	lookups = append(lookups,
+		lookupCase{anyRules, "A\x01", "A, one, then 1"},
+		lookupCase{anyRules, "A\x02", "A, then 2"},
+	)
+	checkLookups(t, lookups)
+}
+
+func Test_LookupStringCompare(t *testing.T) {
+	rules := "0\tstring\t=HDR\thdr\n" +
+		">3\tstring\t>\\0\t\\b, name %s\n" +
+		">>&1\tstring\tx\t\\b, then %s\n" +
+		">3\tstring\t<B\t\\b, before B\n" +
+		">3\tsearch/16\t!qq\t\\b, no qq\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "HDRabc\x00zz\nmore", "hdr, name abc, then zz, no qq"},
+		{rules, "HDR\x00", "hdr, before B, no qq"},
+	})
+}
+
+func Test_LookupSearchFlags(t *testing.T) {
+	rules := "0\tsearch/64/c\t<html\tHTML document\n" +
+		">&0\tsearch/cW/32\t<body\\ class\t\\b, with body\n" +
+		">>&0\tbyte\tx\t\\b, then %c\n" +
+		"0\tsearch/3\tXYZ\tXYZ\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "<!doctype>\n<HTML>\n<BODY   CLASS=\"x\">", "HTML document, with body, then ="},
+		// the match has to start within the range, but may end past it
+		{rules, "AAXYZ", "XYZ"},
+		{rules, "AAAXYZ", ""},
+	})
+}
+
+func Test_LookupDER(t *testing.T) {
+	rules := "0\tder\tseq\tDER sequence\n" +
+		">&0\tder\tint1=00\t\\b, version %s\n" +
+		">>&0\tder\tseq\n" +
+		">>>&0\tder\tobj_id\t\\b, algorithm %s\n" +
+		">>>>&0\tder\tprt_str\t\\b, name %s\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "\x30\x0f" + "\x02\x01\x00" + "\x30\x0a\x06\x03\x2a\x03\x04\x13\x03abc", "DER sequence, version 00, algorithm 2a0304, name abc"},
+		// indefinite lengths aren't DER
+		{rules, "\x30\x80\x02\x01\x00\x00\x00", ""},
+	})
+}
+
+func Test_LookupTextBinary(t *testing.T) {
+	rules := "0\tstring/t\tMZ\ttext starting with MZ\n" +
+		"0\tstring/b\tMZ\tMZ executable\n"
+
+	checkLookups(t, []lookupCase{
+		{rules, "MZ is a plain sentence\n", "text starting with MZ"},
+		{rules, "MZ\x90\x00\x03\x00\x00\x00", "MZ executable"},
+		// latin-1 is text too
+		{rules, "MZ caf\xe9 au lait\n", "text starting with MZ"},
+	})
+}
+
+func Test_Identify(t *testing.T) {
+	magdir := fstest.MapFS{
+		"images": &fstest.MapFile{
+			Data: []byte("# GIF\n0\tstring\tGIF8\tGIF image data\n!:mime\timage/gif\n>4\tbyte\tx\t\\b, version 8%c\n"),
+		},
+	}
+
+	m, err := New(WithMagdirFS(magdir))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	res, err := m.Identify([]byte("GIF89a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "GIF image data, version 89", res.Description)
+	assert.Equal(t, "image/gif", res.Mime)
+	assert.Equal(t, 70, res.Strength)
+	assert.Equal(t, []magic.Match{
+		{Source: "images", Line: 2, Level: 0, Offset: 0, Value: "GIF8", Description: "GIF image data", Mime: "image/gif"},
+		{Source: "images", Line: 4, Level: 1, Offset: 4, Value: int8('9'), Description: "\\b, version 89"},
+	}, res.Matches)
+}
@@ -17,17 +17,31 @@ var (
 var appArgs = struct {
 	debugParser      *bool
 	debugInterpreter *bool
+	strict           *bool
 }{
 	app.Flag("debug-parser", "Turn on verbose parser output").Bool(),
 	app.Flag("debug-interpreter", "Turn on verbose interpreter output").Bool(),
+	app.Flag("strict", "Fail on malformed or unsupported magic rules instead of skipping them").Bool(),
 }
 
 var identifyArgs = struct {
-	magdir *string
-	target *string
+	magdir    *string
+	target    *string
+	mimeType  *bool
+	mime      *bool
+	extension *bool
+	apple     *bool
+	list      *bool
+	keepGoing *bool
 }{
 	identifyCmd.Arg("magdir", "the folder of magic files to compile").Required().String(),
-	identifyCmd.Arg("target", "path of the the file to identify").Required().String(),
+	identifyCmd.Arg("target", "path of the the file to identify").String(),
+	identifyCmd.Flag("mime-type", "print the MIME type instead of a description").Bool(),
+	identifyCmd.Flag("mime", "print the MIME type and character set, like file -i").Short('i').Bool(),
+	identifyCmd.Flag("extension", "print the usual file extensions, separated by slashes").Bool(),
+	identifyCmd.Flag("apple", "print the classic Mac OS creator and type codes").Bool(),
+	identifyCmd.Flag("list", "list top-level rules with their strength instead of identifying").Bool(),
+	identifyCmd.Flag("keep-going", "report every matching rule, not just the first one").Short('k').Bool(),
 }
 
 var compileArgs = struct {
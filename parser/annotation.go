@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/postfix/golibmagic/util"
+)
+
+// parseAnnotation reads a "!:key value" line, which adds information
+// to the rule right before it
+func (ctx *ParseContext) parseAnnotation(pos position, line []byte, rule *Rule) {
+	if len(line) < 2 || line[1] != ':' {
+		ctx.errorf(pos, 2, "malformed annotation, expected '!:'")
+		return
+	}
+
+	i := 2
+	keyStart := i
+	for i < len(line) && !util.IsWhitespace(line[i]) {
+		i++
+	}
+	key := string(line[keyStart:i])
+
+	for i < len(line) && util.IsWhitespace(line[i]) {
+		i++
+	}
+	valueStart := i
+	value := strings.TrimSpace(string(line[i:]))
+
+	if rule == nil {
+		ctx.errorf(pos, 1, "annotation %s doesn't follow a valid rule", key)
+		return
+	}
+
+	switch key {
+	case "mime":
+		rule.Mime = value
+	case "ext":
+		for _, ext := range strings.Split(value, "/") {
+			if ext != "" {
+				rule.Extensions = append(rule.Extensions, ext)
+			}
+		}
+	case "apple":
+		// four-character creator code followed by four-character type code
+		if len(value) != 8 {
+			ctx.errorf(pos, valueStart+1, "apple annotation %q should be 8 characters long", value)
+			return
+		}
+		rule.Apple = value
+	case "strength":
+		ctx.parseStrength(pos, valueStart, value, rule)
+	default:
+		ctx.errorf(pos, keyStart+1, "unsupported annotation %s", key)
+	}
+}
+
+// parseStrength reads the value of a strength annotation, like "+ 10" or "*2",
+// which starts at index valueStart of its line
+func (ctx *ParseContext) parseStrength(pos position, valueStart int, value string, rule *Rule) {
+	input := []byte(value)
+	if len(input) == 0 {
+		ctx.errorf(pos, valueStart+1, "empty strength annotation")
+		return
+	}
+
+	adjustmentType := AdjustmentNone
+	switch input[0] {
+	case '+':
+		adjustmentType = AdjustmentAdd
+	case '-':
+		adjustmentType = AdjustmentSub
+	case '*':
+		adjustmentType = AdjustmentMul
+	case '/':
+		adjustmentType = AdjustmentDiv
+	default:
+		ctx.errorf(pos, valueStart+1, "unknown strength operator %q", input[0])
+		return
+	}
+
+	j := 1
+	for j < len(input) && util.IsWhitespace(input[j]) {
+		j++
+	}
+
+	parsedValue, err := parseInt(input, j)
+	if err != nil {
+		ctx.errorf(pos, valueStart+j+1, "couldn't parse strength value %q", input[j:])
+		return
+	}
+
+	if adjustmentType == AdjustmentDiv && parsedValue.Value == 0 {
+		ctx.errorf(pos, valueStart+j+1, "strength divided by zero")
+		return
+	}
+
+	rule.StrengthAdjustmentType = adjustmentType
+	rule.StrengthAdjustmentValue = parsedValue.Value
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"encoding/binary"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -17,13 +18,30 @@ func (sb Spellbook) AddRule(page string, rule Rule) {
 	sb[page] = append(sb[page], rule)
 }
 
+// lastRule returns the rule most recently added to a page, if any
+func (sb Spellbook) lastRule(page string) *Rule {
+	rules := sb[page]
+	if len(rules) == 0 {
+		return nil
+	}
+	return &rules[len(rules)-1]
+}
+
 // Rule is a single magic rule
 type Rule struct {
+	Source      string
+	LineNumber  int
 	Line        string
 	Level       int
 	Offset      Offset
 	Kind        Kind
 	Description []byte
+	Mime        string
+	Extensions  []string
+	Apple       string
+
+	StrengthAdjustmentType  Adjustment
+	StrengthAdjustmentValue int64
 }
 
 func (r Rule) String() string {
@@ -141,9 +159,28 @@ func (o Offset) Equals(b Offset) bool {
 		return false
 	}
 
+	if ai.ID3 != bi.ID3 {
+		return false
+	}
+
 	return true
 }
 
+// StringTestFlags returns the flags of string-like kinds, or 0 for other kinds
+func (k Kind) StringTestFlags() magic.StringTestFlags {
+	switch data := k.Data.(type) {
+	case *StringKind:
+		return data.Flags
+	case *SearchKind:
+		return data.Flags
+	case *String16Kind:
+		return data.Flags
+	case *PstringKind:
+		return data.Flags
+	}
+	return 0
+}
+
 func (k Kind) String() string {
 	switch k.Family {
 	case KindFamilyInteger:
@@ -162,10 +199,19 @@ func (k Kind) String() string {
 		case 8:
 			s += "quad"
 		}
-		if ik.Endianness == LittleEndian {
+		switch ik.Endianness {
+		case LittleEndian:
 			s += "le"
-		} else {
+		case BigEndian:
 			s += "be"
+		case MiddleEndian:
+			s += "me"
+		}
+		if ik.ID3 {
+			s += "id3"
+		}
+		if ik.Date != magic.DateNone {
+			s += "date"
 		}
 		s += "    "
 		s += fmt.Sprintf("%x", ik.Value)
@@ -176,9 +222,40 @@ func (k Kind) String() string {
 	case KindFamilyString:
 		sk, _ := k.Data.(*StringKind)
 		return fmt.Sprintf("string    %s", strconv.Quote(string(sk.Value)))
+	case KindFamilyString16:
+		sk, _ := k.Data.(*String16Kind)
+		return fmt.Sprintf("%s string16    %s", sk.Endianness, strconv.Quote(string(sk.Value)))
 	case KindFamilySearch:
 		sk, _ := k.Data.(*SearchKind)
 		return fmt.Sprintf("search/0x%x    %s", sk.MaxLen, strconv.Quote(string(sk.Value)))
+	case KindFamilyFloat:
+		fk, _ := k.Data.(*FloatKind)
+		s := "float"
+		if fk.ByteWidth == 8 {
+			s = "double"
+		}
+		return fmt.Sprintf("%s %s    %g", fk.Endianness, s, fk.Value)
+	case KindFamilyPstring:
+		pk, _ := k.Data.(*PstringKind)
+		return fmt.Sprintf("pstring/%d    %s", pk.LengthWidth, strconv.Quote(string(pk.Value)))
+	case KindFamilyRegex:
+		rk, _ := k.Data.(*RegexKind)
+		return fmt.Sprintf("regex/%d    %s", rk.Count, strconv.Quote(string(rk.Value)))
+	case KindFamilyOffset:
+		ofk, _ := k.Data.(*OffsetKind)
+		return fmt.Sprintf("offset    %d", ofk.Value)
+	case KindFamilyGUID:
+		gk, _ := k.Data.(*GUIDKind)
+		return fmt.Sprintf("guid    %s", gk.Value)
+	case KindFamilyDER:
+		dk, _ := k.Data.(*DERKind)
+		return fmt.Sprintf("der    %s", dk.Value)
+	case KindFamilyIndirect:
+		ik, _ := k.Data.(*IndirectKind)
+		if ik.Relative {
+			return "indirect/r"
+		}
+		return "indirect"
 	case KindFamilyDefault:
 		return "default"
 	case KindFamilyClear:
@@ -204,16 +281,23 @@ type Endianness int
 
 // ByteOrder translates our in-house Endianness constant into a binary.ByteOrder decoder
 func (en Endianness) ByteOrder() binary.ByteOrder {
-	if en == BigEndian {
+	switch en {
+	case BigEndian:
 		return binary.BigEndian
+	case MiddleEndian:
+		return magic.MiddleEndian
 	}
 	return binary.LittleEndian
 }
 
-// Swapped returns LittleEndian if you give it BigEndian, and vice versa
+// Swapped returns LittleEndian if you give it BigEndian, and vice versa.
+// MiddleEndian stays as-is.
 func (en Endianness) Swapped() Endianness {
-	if en == BigEndian {
+	switch en {
+	case BigEndian:
 		return LittleEndian
+	case MiddleEndian:
+		return MiddleEndian
 	}
 	return BigEndian
 }
@@ -227,8 +311,11 @@ func (en Endianness) MaybeSwapped(swap bool) Endianness {
 }
 
 func (en Endianness) String() string {
-	if en == BigEndian {
+	switch en {
+	case BigEndian:
 		return "big-endian"
+	case MiddleEndian:
+		return "middle-endian"
 	}
 	return "little-endian"
 }
@@ -238,6 +325,8 @@ const (
 	LittleEndian Endianness = iota
 	// BigEndian numbers are stored with the most significant byte first
 	BigEndian
+	// MiddleEndian numbers are stored like on the PDP-11, see magic.MiddleEndian
+	MiddleEndian
 )
 
 // Kind describes the type of tests a magic rule performs
@@ -258,6 +347,15 @@ type IntegerKind struct {
 	MatchAny        bool
 	AdjustmentType  Adjustment
 	AdjustmentValue int64
+	// Date is set if the integer is a timestamp, see the date kinds
+	Date magic.DateFormat
+	// ID3 is set if the integer is synchsafe, see magic.ID3Value
+	ID3 bool
+	// Invert is set by a ~ right after the kind name, as in "byte~&0x0f".
+	// Like libmagic, it flips the bits of the value read from the target,
+	// after any mask or adjustment, so %d prints the flipped value too.
+	// A ~ in front of the test value, as in magic(5), negates Value instead.
+	Invert bool
 }
 
 type SwitchKind struct {
@@ -270,35 +368,97 @@ type SwitchKind struct {
 type SwitchCase struct {
 	Value       int64
 	Description []byte
+	// Rule is the integer rule this case was generated from
+	Rule Rule
 }
 
-// IntegerTest describes which comparison to perform on an integer
-type IntegerTest int
+// IntegerTest describes which comparison to perform on an integer,
+// see magic.MatchInteger
+type IntegerTest = magic.IntegerTest
 
 const (
 	// IntegerTestEqual tests that two integers have the same value
-	IntegerTestEqual IntegerTest = iota
+	IntegerTestEqual = magic.IntegerTestEqual
 	// IntegerTestNotEqual tests that two integers have different values
-	IntegerTestNotEqual
+	IntegerTestNotEqual = magic.IntegerTestNotEqual
 	// IntegerTestLessThan tests that one integer is less than the other
-	IntegerTestLessThan
+	IntegerTestLessThan = magic.IntegerTestLessThan
 	// IntegerTestGreaterThan tests that one integer is greater than the other
-	IntegerTestGreaterThan
+	IntegerTestGreaterThan = magic.IntegerTestGreaterThan
 	// IntegerTestAnd tests that all the bits in the pattern are set
-	IntegerTestAnd
+	IntegerTestAnd = magic.IntegerTestAnd
+	// IntegerTestClear tests that at least one of the bits in the pattern is clear
+	IntegerTestClear = magic.IntegerTestClear
 )
 
+// FloatKind describes how to perform a test on an IEEE 754 number
+type FloatKind struct {
+	ByteWidth  int
+	Endianness Endianness
+	// FloatTest is one of IntegerTestEqual, NotEqual, LessThan or GreaterThan
+	FloatTest IntegerTest
+	Value     float64
+	MatchAny  bool
+}
+
 // StringKind describes how to match a string pattern
 type StringKind struct {
 	Value  []byte
 	Negate bool
 	Flags  magic.StringTestFlags
+	// StringTest is IntegerTestLessThan or IntegerTestGreaterThan to compare
+	// the target with Value in byte order, like "string >\0" does to check
+	// for a non-empty string, or IntegerTestEqual otherwise
+	StringTest IntegerTest
+	MatchAny   bool
+	// MaxLen limits how many bytes of the target are looked at, if non-zero
+	MaxLen int64
+}
+
+// CutAtNewline returns whether the target string printed by an ordered or
+// "x" string test stops at line breaks, as it does when Value starts with NUL
+func (sk *StringKind) CutAtNewline() bool {
+	return len(sk.Value) == 0 || sk.Value[0] == 0
+}
+
+// String16Kind describes how to match a string pattern against UTF-16 text
+type String16Kind struct {
+	Value      []byte
+	Negate     bool
+	MatchAny   bool
+	Flags      magic.StringTestFlags
+	Endianness Endianness
 }
 
 // SearchKind describes how to look for a fixed pattern
 type SearchKind struct {
 	Value  []byte
+	Negate bool
+	// MaxLen is the range: how many positions of the target to try
 	MaxLen int64
+	Flags  magic.StringTestFlags
+}
+
+// PstringKind describes how to match a string stored after its length
+type PstringKind struct {
+	Value    []byte
+	Negate   bool
+	MatchAny bool
+	Flags    magic.StringTestFlags
+
+	LengthWidth          int
+	LengthEndianness     Endianness
+	LengthIncludesItself bool
+}
+
+// RegexKind describes how to match a regular expression
+type RegexKind struct {
+	Value  []byte
+	Negate bool
+	// Count is how many bytes (or lines) to look at, 0 means as many as allowed
+	Count  int64
+	Flags  magic.RegexTestFlags
+	Regexp *regexp.Regexp
 }
 
 // KindFamily groups tests in families (all integer tests, for example)
@@ -319,6 +479,22 @@ const (
 	KindFamilyName
 	// KindFamilyUse acts like a subroutine call, to peruse another page of rules
 	KindFamilyUse
+	// KindFamilyRegex looks for a regular expression in a slice of the target
+	KindFamilyRegex
+	// KindFamilyPstring looks for a string that is preceded by its length
+	KindFamilyPstring
+	// KindFamilyFloat tests floating-point numbers for equality, inequality, etc.
+	KindFamilyFloat
+	// KindFamilyString16 looks for a string in UTF-16 text
+	KindFamilyString16
+	// KindFamilyIndirect runs the top-level rules again at an offset
+	KindFamilyIndirect
+	// KindFamilyOffset tests the offset a rule points to, rather than the target
+	KindFamilyOffset
+	// KindFamilyGUID compares a Microsoft GUID
+	KindFamilyGUID
+	// KindFamilyDER checks an ASN.1 DER element, like in certificates and keys
+	KindFamilyDER
 
 	// Compiler additions begin
 
@@ -353,6 +529,8 @@ type IndirectOffset struct {
 	OffsetAdjustmentType       Adjustment
 	OffsetAdjustmentIsRelative bool
 	OffsetAdjustmentValue      int64
+	// ID3 is set if the offset is synchsafe, see magic.ID3Value
+	ID3 bool
 }
 
 // Adjustment describes which operation to apply to an offset
@@ -369,8 +547,42 @@ const (
 	AdjustmentMul
 	// AdjustmentDiv divides by a value
 	AdjustmentDiv
+	// AdjustmentOr sets the bits of a value, for integer kinds only
+	AdjustmentOr
+	// AdjustmentXor flips the bits of a value, for integer kinds only
+	AdjustmentXor
 )
 
+// OffsetKind describes a test on the offset a rule points to
+type OffsetKind struct {
+	// IntegerTest is one of IntegerTestEqual, NotEqual, LessThan or GreaterThan
+	IntegerTest IntegerTest
+	Value       int64
+	MatchAny    bool
+}
+
+// GUIDKind describes how to match a Microsoft GUID
+type GUIDKind struct {
+	// Value is in the form magic.ReadGUID returns
+	Value    string
+	MatchAny bool
+}
+
+// DERKind describes how to match an ASN.1 DER element
+type DERKind struct {
+	// Value is the test as written, empty to match any element
+	Value string
+	// Pattern is Value, parsed, or nil to match any element
+	Pattern *magic.DERPattern
+}
+
+// IndirectKind describes where to identify the target again
+type IndirectKind struct {
+	// Relative is set if the offset is relative to the start of the page
+	// being used, instead of the start of the target
+	Relative bool
+}
+
 // UseKind describes which page of the spellbook to use, and whether or not to swap endianness
 type UseKind struct {
 	SwapEndian bool
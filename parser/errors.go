@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError describes why a line of a magic file couldn't be parsed
+type ParseError struct {
+	// Source is the name of the magic file, if known
+	Source string
+	// Line is the 1-based line number of the faulty rule
+	Line int
+	// Column is the 1-based position in the line where the problem was found
+	Column int
+	// Reason is a human-readable description of the problem
+	Reason string
+}
+
+func (pe *ParseError) Error() string {
+	source := pe.Source
+	if source == "" {
+		source = "<magic>"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", source, pe.Line, pe.Column, pe.Reason)
+}
+
+// ParseErrors is returned by strict parse contexts when some rules couldn't be parsed
+type ParseErrors []*ParseError
+
+func (pe ParseErrors) Error() string {
+	var lines []string
+	for _, e := range pe {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// position locates a line of a magic file
+type position struct {
+	source string
+	line   int
+}
+
+// errorf records a parse error at the given column of a line, and logs it
+func (ctx *ParseContext) errorf(pos position, column int, format string, args ...interface{}) {
+	pe := &ParseError{
+		Source: pos.source,
+		Line:   pos.line,
+		Column: column,
+		Reason: fmt.Sprintf(format, args...),
+	}
+	ctx.Errors = append(ctx.Errors, pe)
+	ctx.Logf("error: %s", pe)
+}
+
+// strictErrors returns the errors recorded after the first numErrors ones,
+// if the context is strict
+func (ctx *ParseContext) strictErrors(numErrors int) error {
+	if !ctx.Strict || len(ctx.Errors) <= numErrors {
+		return nil
+	}
+
+	errs := make(ParseErrors, len(ctx.Errors)-numErrors)
+	copy(errs, ctx.Errors[numErrors:])
+	return errs
+}
+
+// at returns input[j], or 0 if j is out of bounds
+func at(input []byte, j int) byte {
+	if j < 0 || j >= len(input) {
+		return 0
+	}
+	return input[j]
+}
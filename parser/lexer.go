@@ -21,11 +21,13 @@ type parsedUint struct {
 func parseInt(input []byte, j int) (*parsedInt, error) {
 	inputSize := len(input)
 
-	startJ := j
+	negative := false
 	if j < inputSize && input[j] == '-' {
+		negative = true
 		j++
 	}
 
+	startJ := j
 	base := 10
 
 	if (j+1 < inputSize) && input[j] == '0' && input[j+1] == 'x' {
@@ -51,11 +53,17 @@ func parseInt(input []byte, j int) (*parsedInt, error) {
 		}
 	}
 
-	value, err := strconv.ParseInt(string(input[startJ:j]), base, 64)
+	// like strtoull, values too large for an int64 wrap around
+	unsignedValue, err := strconv.ParseUint(string(input[startJ:j]), base, 64)
 	if err != nil {
 		return nil, err
 	}
 
+	value := int64(unsignedValue)
+	if negative {
+		value = -value
+	}
+
 	return &parsedInt{
 		Value:    value,
 		NewIndex: j,
@@ -132,6 +140,10 @@ func parseString(input []byte, j int) (*parsedString, error) {
 	for j < inputSize {
 		if input[j] == '\\' {
 			j++
+			if j >= inputSize {
+				return nil, fmt.Errorf("unfinished escape sequence at the end of %s", input)
+			}
+
 			switch input[j] {
 			case '\\':
 				result = append(result, '\\')
@@ -198,7 +210,10 @@ func parseString(input []byte, j int) (*parsedString, error) {
 					result = append(result, byte(val))
 					j = k
 				} else {
-					return nil, fmt.Errorf("unrecognized escape sequence starting with 0x%x, aka '\\%c'", input[j], input[j])
+					// like libmagic, keep the escaped character as-is,
+					// so that \< means '<'
+					result = append(result, input[j])
+					j++
 				}
 			}
 		} else {
@@ -215,33 +230,157 @@ func parseString(input []byte, j int) (*parsedString, error) {
 
 type parsedStringTestFlags struct {
 	Flags    magic.StringTestFlags
+	MaxLen   int64
 	NewIndex int
 }
 
-func parseStringTestFlags(input []byte, j int) *parsedStringTestFlags {
+// parseStringTestFlags reads the suffixes of a string kind, like "/cW" or
+// "/16/T", where a number limits how much of the target is looked at
+func parseStringTestFlags(input []byte, j int) (*parsedStringTestFlags, error) {
 	inputSize := len(input)
 
 	result := &parsedStringTestFlags{}
 
+	for j < inputSize {
+		c := input[j]
+		switch {
+		case c == '/':
+			j++
+		case util.IsNumber(c):
+			parsedLen, err := parseUint(input, j)
+			if err != nil {
+				return nil, err
+			}
+			result.MaxLen = int64(parsedLen.Value)
+			j = parsedLen.NewIndex
+		default:
+			flag := stringTestFlag(c)
+			if flag == 0 {
+				return nil, fmt.Errorf("unknown flag '%c'", c)
+			}
+			result.Flags |= flag
+			j++
+		}
+	}
+
+	result.NewIndex = j
+	return result, nil
+}
+
+// stringTestFlag returns the string test flag for a character of a kind
+// suffix, or 0 if there's none
+func stringTestFlag(c byte) magic.StringTestFlags {
+	switch c {
+	case 'W':
+		return magic.CompactWhitespace
+	case 'w':
+		return magic.OptionalBlanks
+	case 'c':
+		return magic.LowerMatchesBoth
+	case 'C':
+		return magic.UpperMatchesBoth
+	case 't':
+		return magic.ForceText
+	case 'b':
+		return magic.ForceBinary
+	case 'T':
+		return magic.Trim
+	case 'f':
+		return magic.FullWord
+	}
+	return 0
+}
+
+type parsedPstringTestFlags struct {
+	LengthWidth          int
+	LengthEndianness     Endianness
+	LengthIncludesItself bool
+	Flags                magic.StringTestFlags
+	NewIndex             int
+}
+
+// parsePstringTestFlags reads the suffixes of a pstring kind, like "/H" or "/hJ"
+func parsePstringTestFlags(input []byte, j int) (*parsedPstringTestFlags, error) {
+	inputSize := len(input)
+
+	result := &parsedPstringTestFlags{
+		LengthWidth:      1,
+		LengthEndianness: BigEndian,
+	}
+
 	for j < inputSize {
 		switch input[j] {
-		case 'W':
-			result.Flags |= magic.CompactWhitespace
-		case 'w':
-			result.Flags |= magic.OptionalBlanks
-		case 'c':
-			result.Flags |= magic.LowerMatchesBoth
-		case 'C':
-			result.Flags |= magic.UpperMatchesBoth
-		case 't':
-			result.Flags |= magic.ForceText
-		case 'b':
-			result.Flags |= magic.ForceBinary
+		case '/':
+			// flags may be given in several groups
+		case 'B':
+			result.LengthWidth = 1
+		case 'H':
+			result.LengthWidth = 2
+			result.LengthEndianness = BigEndian
+		case 'h':
+			result.LengthWidth = 2
+			result.LengthEndianness = LittleEndian
+		case 'L':
+			result.LengthWidth = 4
+			result.LengthEndianness = BigEndian
+		case 'l':
+			result.LengthWidth = 4
+			result.LengthEndianness = LittleEndian
+		case 'J':
+			result.LengthIncludesItself = true
 		default:
-			break
+			flag := stringTestFlag(input[j])
+			if flag == 0 {
+				return nil, fmt.Errorf("unknown pstring flag '%c'", input[j])
+			}
+			result.Flags |= flag
 		}
 		j++
 	}
 
-	return result
+	result.NewIndex = j
+	return result, nil
+}
+
+type parsedRegexTestFlags struct {
+	Count    int64
+	Flags    magic.RegexTestFlags
+	NewIndex int
+}
+
+// parseRegexTestFlags reads the suffixes of a regex kind, like "/100l" or "/c"
+func parseRegexTestFlags(input []byte, j int) (*parsedRegexTestFlags, error) {
+	inputSize := len(input)
+
+	result := &parsedRegexTestFlags{}
+
+	for j < inputSize && input[j] == '/' {
+		j++
+
+		if j < inputSize && util.IsNumber(input[j]) {
+			parsedCount, err := parseUint(input, j)
+			if err != nil {
+				return nil, err
+			}
+			result.Count = int64(parsedCount.Value)
+			j = parsedCount.NewIndex
+		}
+
+		for j < inputSize && input[j] != '/' {
+			switch input[j] {
+			case 'c':
+				result.Flags |= magic.RegexIgnoreCase
+			case 's':
+				result.Flags |= magic.RegexOffsetStart
+			case 'l':
+				result.Flags |= magic.RegexLineCount
+			default:
+				return nil, fmt.Errorf("unknown regex flag '%c'", input[j])
+			}
+			j++
+		}
+	}
+
+	result.NewIndex = j
+	return result, nil
 }
@@ -2,14 +2,17 @@ package parser
 
 import (
 	"bufio"
-	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
+	"math"
 	"os"
-	"path/filepath"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/postfix/golibmagic/magic"
 	"github.com/postfix/golibmagic/util"
 )
 
@@ -19,25 +22,43 @@ type LogFunc func(format string, args ...interface{})
 // ParseContext holds state for the parser
 type ParseContext struct {
 	Logf LogFunc
+
+	// Strict makes parsing fail if any rule is malformed or unsupported,
+	// instead of skipping it
+	Strict bool
+
+	// Errors lists every rule or annotation that was skipped so far
+	Errors []*ParseError
 }
 
 // ParseAll parses all the files in a directory and adds them to the same spellbook
 func (ctx *ParseContext) ParseAll(magdir string, book Spellbook) error {
-	files, err := ioutil.ReadDir(magdir)
+	return ctx.ParseFS(os.DirFS(magdir), ".", book)
+}
+
+// ParseFS parses all the files in a directory of fsys and adds them to the same spellbook
+func (ctx *ParseContext) ParseFS(fsys fs.FS, magdir string, book Spellbook) error {
+	numErrors := len(ctx.Errors)
+
+	files, err := fs.ReadDir(fsys, magdir)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	for _, magicFile := range files {
+		if magicFile.IsDir() {
+			continue
+		}
+
 		err = func() error {
-			f, err := os.Open(filepath.Join(magdir, magicFile.Name()))
+			f, err := fsys.Open(path.Join(magdir, magicFile.Name()))
 			if err != nil {
 				return errors.WithStack(err)
 			}
 
 			defer f.Close()
 
-			err = ctx.Parse(f, book)
+			err = ctx.parse(magicFile.Name(), f, book)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -50,19 +71,37 @@ func (ctx *ParseContext) ParseAll(magdir string, book Spellbook) error {
 		}
 	}
 
-	return nil
+	return ctx.strictErrors(numErrors)
 }
 
 // Parse reads a magic rule file and puts it into a spell book
 func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
+	numErrors := len(ctx.Errors)
+
+	err := ctx.parse("", magicReader, book)
+	if err != nil {
+		return err
+	}
+
+	return ctx.strictErrors(numErrors)
+}
+
+// parse is Parse, for a magic file with the given name
+func (ctx *ParseContext) parse(source string, magicReader io.Reader, book Spellbook) error {
 	scanner := bufio.NewScanner(magicReader)
 
 	page := ""
+	lineNumber := 0
+
+	// the rule "!:" annotations get attached to, if it parsed fine
+	var lastRule *Rule
 
 	for scanner.Scan() {
+		lineNumber++
 		line := scanner.Text()
 		lineBytes := []byte(line)
 		numBytes := len(lineBytes)
+		pos := position{source: source, line: lineNumber}
 
 		if numBytes == 0 {
 			// empty line, ignore
@@ -77,11 +116,16 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 		}
 
 		if lineBytes[i] == '!' {
+			ctx.parseAnnotation(pos, lineBytes, lastRule)
 			continue
 		}
 
+		lastRule = nil
+
 		rule := Rule{}
 
+		rule.Source = source
+		rule.LineNumber = lineNumber
 		rule.Line = line
 
 		// read level
@@ -136,6 +180,10 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				i++
 			}
 		}
+		if i > numBytes {
+			// line ends with a backslash
+			i = numBytes
+		}
 		testEnd := i
 		test := lineBytes[testStart:testEnd]
 
@@ -150,27 +198,32 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 		{
 			offsetBytes := []byte(offset)
 			j := 0
-			if offsetBytes[j] == '&' {
+			if len(offsetBytes) == 0 {
+				ctx.errorf(pos, offsetStart+1, "missing offset")
+				continue
+			}
+
+			if at(offsetBytes, j) == '&' {
 				// offset is relative to globalOffset
 				rule.Offset.IsRelative = true
 				j++
 			}
 
-			if offsetBytes[j] == '(' {
+			if at(offsetBytes, j) == '(' {
 				j++
 				rule.Offset.OffsetType = OffsetTypeIndirect
 
 				indirect := &IndirectOffset{}
 				rule.Offset.Indirect = indirect
 
-				if offsetBytes[j] == '&' {
+				if at(offsetBytes, j) == '&' {
 					indirect.IsRelative = true
 					j++
 				}
 
 				indirectAddr, err := parseInt(offsetBytes, j)
 				if err != nil {
-					ctx.Logf("error: couldn't parse indirect offset in part \"%s\" of rule %s", offsetBytes[j:], line)
+					ctx.errorf(pos, offsetStart+j+1, "couldn't parse indirect offset address %q", offsetBytes[j:])
 					continue
 				}
 
@@ -178,13 +231,13 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				indirect.OffsetAddress = indirectAddr.Value
 
-				if offsetBytes[j] != '.' && offsetBytes[j] != ',' {
-					ctx.Logf("malformed indirect offset in %s, expected [.,], got '%c'\n", string(offsetBytes), offsetBytes[j])
+				if at(offsetBytes, j) != '.' && at(offsetBytes, j) != ',' {
+					ctx.errorf(pos, offsetStart+j+1, "malformed indirect offset %s, expected '.' or ','", offsetBytes)
 					continue
 				}
 				j++
 
-				indirectAddrFormat := offsetBytes[j]
+				indirectAddrFormat := at(offsetBytes, j)
 				j++
 
 				indirect.Endianness = LittleEndian
@@ -198,41 +251,45 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				case 'b':
 					indirect.ByteWidth = 1
 				case 'i':
-					ctx.Logf("id3 format not supported, skipping %s", line)
-					continue
+					indirect.ByteWidth = 4
+					indirect.ID3 = true
 				case 's':
 					indirect.ByteWidth = 2
 				case 'l':
 					indirect.ByteWidth = 4
 				case 'm':
-					ctx.Logf("middle-endian format not supported, skipping %s", line)
-					continue
+					indirect.ByteWidth = 4
+					indirect.Endianness = MiddleEndian
 				default:
-					ctx.Logf("unsupported indirect addr format %c, skipping %s", indirectAddrFormat, line)
+					ctx.errorf(pos, offsetStart+j, "unsupported indirect offset format %q", indirectAddrFormat)
 					continue
 				}
 
-				if offsetBytes[j] == '+' {
+				if at(offsetBytes, j) == '+' {
 					indirect.OffsetAdjustmentType = AdjustmentAdd
-				} else if offsetBytes[j] == '-' {
+				} else if at(offsetBytes, j) == '-' {
 					indirect.OffsetAdjustmentType = AdjustmentSub
-				} else if offsetBytes[j] == '*' {
+				} else if at(offsetBytes, j) == '*' {
 					indirect.OffsetAdjustmentType = AdjustmentMul
-				} else if offsetBytes[j] == '/' {
+				} else if at(offsetBytes, j) == '/' {
 					indirect.OffsetAdjustmentType = AdjustmentDiv
 				}
 
 				if indirect.OffsetAdjustmentType != AdjustmentNone {
 					j++
 					// it's a relative pair
-					if offsetBytes[j] == '(' {
+					if at(offsetBytes, j) == '(' {
 						indirect.OffsetAdjustmentIsRelative = true
 						j++
 					}
 
 					parsedRHS, err := parseInt(offsetBytes, j)
 					if err != nil {
-						ctx.Logf("malformed indirect offset rhs, skipping %s", line)
+						ctx.errorf(pos, offsetStart+j+1, "couldn't parse indirect offset adjustment %q", offsetBytes[j:])
+						continue
+					}
+					if indirect.OffsetAdjustmentType == AdjustmentDiv && !indirect.OffsetAdjustmentIsRelative && parsedRHS.Value == 0 {
+						ctx.errorf(pos, offsetStart+j+1, "indirect offset adjustment divides by zero")
 						continue
 					}
 
@@ -240,16 +297,16 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					j = parsedRHS.NewIndex
 
 					if indirect.OffsetAdjustmentIsRelative {
-						if offsetBytes[j] != ')' {
-							ctx.Logf("malformed relative offset adjustment, missing closing ')' - in %s", line)
+						if at(offsetBytes, j) != ')' {
+							ctx.errorf(pos, offsetStart+j+1, "malformed relative offset adjustment, expected ')'")
 							continue
 						}
 						j++
 					}
 				}
 
-				if offsetBytes[j] != ')' {
-					ctx.Logf("malformed indirect offset in %s, expected ')', got '%c', skipping", string(offsetBytes), offsetBytes[j])
+				if at(offsetBytes, j) != ')' {
+					ctx.errorf(pos, offsetStart+j+1, "malformed indirect offset %s, expected ')'", offsetBytes)
 					continue
 				}
 				j++
@@ -258,7 +315,7 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				parsedAbsolute, err := parseInt(offsetBytes, j)
 				if err != nil {
-					ctx.Logf("malformed absolute offset, expected number, got (%s), skipping", offsetBytes[j:])
+					ctx.errorf(pos, offsetStart+j+1, "malformed absolute offset %q, expected a number", offsetBytes[j:])
 					continue
 				}
 
@@ -280,7 +337,13 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				"uleshort", "ulelong", "ulequad",
 				"byte", "short", "long", "quad",
 				"beshort", "belong", "bequad",
-				"leshort", "lelong", "lequad":
+				"leshort", "lelong", "lequad",
+				"melong", "umelong",
+				"beid3", "leid3",
+				"date", "ldate", "qdate", "qldate", "qwdate",
+				"bedate", "beldate", "beqdate", "beqldate", "beqwdate",
+				"ledate", "leldate", "leqdate", "leqldate", "leqwdate",
+				"medate", "meldate":
 
 				ik := &IntegerKind{}
 				rule.Kind.Family = KindFamilyInteger
@@ -300,6 +363,9 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				} else if strings.HasPrefix(simpleKind, "be") {
 					simpleKind = simpleKind[2:]
 					ik.Endianness = BigEndian
+				} else if strings.HasPrefix(simpleKind, "me") {
+					simpleKind = simpleKind[2:]
+					ik.Endianness = MiddleEndian
 				}
 
 				switch simpleKind {
@@ -311,13 +377,36 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					ik.ByteWidth = 4
 				case "quad":
 					ik.ByteWidth = 8
+				case "id3":
+					ik.ByteWidth = 4
+					ik.ID3 = true
+				case "date":
+					ik.ByteWidth = 4
+					ik.Date = magic.DateUTC
+				case "ldate":
+					ik.ByteWidth = 4
+					ik.Date = magic.DateLocal
+				case "qdate":
+					ik.ByteWidth = 8
+					ik.Date = magic.DateUTC
+				case "qldate":
+					ik.ByteWidth = 8
+					ik.Date = magic.DateLocal
+				case "qwdate":
+					ik.ByteWidth = 8
+					ik.Date = magic.DateWindows
 				default:
-					ctx.Logf("unrecognized integer kind %s, skipping rule %s", simpleKind, line)
+					ctx.errorf(pos, kindStart+1, "unrecognized integer kind %s", parsedKind.Value)
 					continue
 				}
 
 				ik.DoAnd = false
 
+				if j < len(kind) && kind[j] == '~' {
+					ik.Invert = true
+					j++
+				}
+
 				if j < len(kind) {
 					switch kind[j] {
 					case '+':
@@ -332,12 +421,22 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					case '/':
 						ik.AdjustmentType = AdjustmentDiv
 						j++
+					case '|':
+						ik.AdjustmentType = AdjustmentOr
+						j++
+					case '^':
+						ik.AdjustmentType = AdjustmentXor
+						j++
 					}
 
 					if ik.AdjustmentType != AdjustmentNone {
 						pi, err := parseInt(kind, j)
 						if err != nil {
-							ctx.Logf("couldn't parser integer kind adjustment in %s, skipping rule %s", kind[j:], line)
+							ctx.errorf(pos, kindStart+j+1, "couldn't parse integer adjustment %q", kind[j:])
+							continue
+						}
+						if ik.AdjustmentType == AdjustmentDiv && pi.Value == 0 {
+							ctx.errorf(pos, kindStart+j+1, "integer adjustment divides by zero")
 							continue
 						}
 						ik.AdjustmentValue = pi.Value
@@ -349,7 +448,7 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					j++
 					parsedAndValue, err := parseUint(kind, j)
 					if err != nil {
-						ctx.Logf("in integer test, couldn't parse and value %s, skipping\n", kind[j:])
+						ctx.errorf(pos, kindStart+j+1, "couldn't parse integer mask %q", kind[j:])
 						continue
 					}
 					ik.DoAnd = true
@@ -361,7 +460,13 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				k := 0
 
-				switch test[k] {
+				negate := false
+				if at(test, k) == '~' {
+					negate = true
+					k++
+				}
+
+				switch at(test, k) {
 				case 'x':
 					ik.MatchAny = true
 					k++
@@ -380,19 +485,89 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				case '&':
 					ik.IntegerTest = IntegerTestAnd
 					k++
+				case '^':
+					ik.IntegerTest = IntegerTestClear
+					k++
+				}
+
+				if !ik.MatchAny && at(test, k) == '=' &&
+					(ik.IntegerTest == IntegerTestAnd || ik.IntegerTest == IntegerTestClear) {
+					// "&=" and "^=" mean the same as "&" and "^"
+					k++
 				}
 
 				if !ik.MatchAny {
 					parsedMagicValue, err := parseInt(test, k)
 					if err != nil {
-						ctx.Logf("for integer test, couldn't parse magic value %s, ignoring", string(test[k:]))
+						ctx.errorf(pos, testStart+k+1, "couldn't parse integer value %q", test[k:])
 						continue
 					}
 
 					ik.Value = parsedMagicValue.Value
+					if negate {
+						ik.Value = ^ik.Value
+					}
 					k = parsedMagicValue.NewIndex
 				}
 
+			case
+				"float", "befloat", "lefloat",
+				"double", "bedouble", "ledouble":
+
+				fk := &FloatKind{}
+				rule.Kind.Family = KindFamilyFloat
+				rule.Kind.Data = fk
+
+				fk.Endianness = LittleEndian
+
+				simpleKind := parsedKind.Value
+				if strings.HasPrefix(simpleKind, "le") {
+					simpleKind = simpleKind[2:]
+				} else if strings.HasPrefix(simpleKind, "be") {
+					simpleKind = simpleKind[2:]
+					fk.Endianness = BigEndian
+				}
+
+				fk.ByteWidth = 4
+				if simpleKind == "double" {
+					fk.ByteWidth = 8
+				}
+
+				fk.FloatTest = IntegerTestEqual
+
+				k := 0
+
+				switch at(test, k) {
+				case 'x':
+					fk.MatchAny = true
+					k++
+				case '=':
+					k++
+				case '!':
+					fk.FloatTest = IntegerTestNotEqual
+					k++
+				case '<':
+					fk.FloatTest = IntegerTestLessThan
+					k++
+				case '>':
+					fk.FloatTest = IntegerTestGreaterThan
+					k++
+				}
+
+				if !fk.MatchAny {
+					value, err := strconv.ParseFloat(string(test[k:]), 64)
+					if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+						ctx.errorf(pos, testStart+k+1, "couldn't parse float value %q", test[k:])
+						continue
+					}
+
+					if fk.ByteWidth == 4 {
+						// compare in the precision of the target
+						value = float64(float32(value))
+					}
+					fk.Value = value
+				}
+
 			case "string":
 				sk := &StringKind{}
 				rule.Kind.Family = KindFamilyString
@@ -400,21 +575,81 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				k := 0
 				sk.Negate = false
-				if test[k] == '!' {
+				sk.StringTest = IntegerTestEqual
+
+				switch at(test, k) {
+				case '=':
+					k++
+				case '!':
+					sk.Negate = true
+					k++
+				case '<':
+					sk.StringTest = IntegerTestLessThan
+					k++
+				case '>':
+					sk.StringTest = IntegerTestGreaterThan
+					k++
+				case 'x':
+					sk.MatchAny = len(test) == 1
+				}
+
+				if !sk.MatchAny {
+					parsedRHS, err := parseString(test, k)
+					if err != nil {
+						ctx.errorf(pos, testStart+k+1, "couldn't parse string value: %s", err.Error())
+						continue
+					}
+					sk.Value = parsedRHS.Value
+				}
+
+				if j < len(kind) && kind[j] == '/' {
+					parsedFlags, err := parseStringTestFlags(kind, j+1)
+					if err != nil {
+						ctx.errorf(pos, kindStart+j+2, "couldn't parse string flags %q: %s", kind[j+1:], err.Error())
+						continue
+					}
+					j = parsedFlags.NewIndex
+					sk.Flags = parsedFlags.Flags
+					sk.MaxLen = parsedFlags.MaxLen
+				}
+
+			case "lestring16", "bestring16":
+				sk := &String16Kind{}
+				rule.Kind.Family = KindFamilyString16
+				rule.Kind.Data = sk
+
+				sk.Endianness = LittleEndian
+				if parsedKind.Value == "bestring16" {
+					sk.Endianness = BigEndian
+				}
+
+				k := 0
+				switch {
+				case at(test, k) == 'x' && len(test) == 1:
+					sk.MatchAny = true
+					k++
+				case at(test, k) == '!':
 					sk.Negate = true
 					k++
 				}
 
 				parsedRHS, err := parseString(test, k)
 				if err != nil {
-					ctx.Logf("in string test, couldn't parse rhs: %s - skipping", err.Error())
+					ctx.errorf(pos, testStart+k+1, "couldn't parse string value: %s", err.Error())
 					continue
 				}
 				sk.Value = parsedRHS.Value
 
 				if j < len(kind) && kind[j] == '/' {
-					j++
-					parsedFlags := parseStringTestFlags(kind, j)
+					parsedFlags, err := parseStringTestFlags(kind, j+1)
+					if err != nil {
+						ctx.errorf(pos, kindStart+j+2, "couldn't parse string16 flags %q: %s", kind[j+1:], err.Error())
+						continue
+					}
+					if parsedFlags.MaxLen > 0 {
+						ctx.errorf(pos, kindStart+j+2, "string16 doesn't support length limits")
+						continue
+					}
 					j = parsedFlags.NewIndex
 					sk.Flags = parsedFlags.Flags
 				}
@@ -426,27 +661,207 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				sk.MaxLen = 8192
 				if j < len(kind) && kind[j] == '/' {
-					j++
-					parsedLen, err := parseUint(kind, j)
+					// flags and range, in any order, like "/2048/cW" or "/c/1"
+					parsedFlags, err := parseStringTestFlags(kind, j+1)
 					if err != nil {
-						ctx.Logf("in search test, couldn't parse max len in %s: %s - skipping\n", kind[j:], err.Error())
+						ctx.errorf(pos, kindStart+j+2, "couldn't parse search flags %q: %s", kind[j+1:], err.Error())
 						continue
 					}
 
-					j = parsedLen.NewIndex
-					sk.MaxLen = int64(parsedLen.Value)
+					j = parsedFlags.NewIndex
+					sk.Flags = parsedFlags.Flags
+					if parsedFlags.MaxLen > 0 {
+						sk.MaxLen = parsedFlags.MaxLen
+					}
 				}
 
 				k := 0
+				switch at(test, k) {
+				case '=':
+					k++
+				case '!':
+					sk.Negate = true
+					k++
+				}
 
 				parsedRHS, err := parseString(test, k)
 				if err != nil {
-					fmt.Printf("in search test, couldn't parse rhs: %s - skipping", err.Error())
+					ctx.errorf(pos, testStart+k+1, "couldn't parse search value: %s", err.Error())
 					continue
 				}
 				k = parsedRHS.NewIndex
 				sk.Value = parsedRHS.Value
 
+			case "pstring":
+				pk := &PstringKind{}
+				rule.Kind.Family = KindFamilyPstring
+				rule.Kind.Data = pk
+
+				if j < len(kind) && kind[j] == '/' {
+					parsedFlags, err := parsePstringTestFlags(kind, j+1)
+					if err != nil {
+						ctx.errorf(pos, kindStart+j+2, "couldn't parse pstring flags %q: %s", kind[j+1:], err.Error())
+						continue
+					}
+					j = parsedFlags.NewIndex
+					pk.LengthWidth = parsedFlags.LengthWidth
+					pk.LengthEndianness = parsedFlags.LengthEndianness
+					pk.LengthIncludesItself = parsedFlags.LengthIncludesItself
+					pk.Flags = parsedFlags.Flags
+				} else {
+					pk.LengthWidth = 1
+				}
+
+				k := 0
+				switch {
+				case at(test, k) == 'x' && len(test) == 1:
+					pk.MatchAny = true
+					k++
+				case at(test, k) == '!':
+					pk.Negate = true
+					k++
+				}
+
+				parsedRHS, err := parseString(test, k)
+				if err != nil {
+					ctx.errorf(pos, testStart+k+1, "couldn't parse pstring value: %s", err.Error())
+					continue
+				}
+				pk.Value = parsedRHS.Value
+
+			case "regex":
+				rk := &RegexKind{}
+				rule.Kind.Family = KindFamilyRegex
+				rule.Kind.Data = rk
+
+				parsedFlags, err := parseRegexTestFlags(kind, j)
+				if err != nil {
+					ctx.errorf(pos, kindStart+j+1, "couldn't parse regex flags %q: %s", kind[j:], err.Error())
+					continue
+				}
+				j = parsedFlags.NewIndex
+				rk.Count = parsedFlags.Count
+				rk.Flags = parsedFlags.Flags
+
+				k := 0
+				switch at(test, k) {
+				case '=':
+					k++
+				case '!':
+					rk.Negate = true
+					k++
+				}
+
+				parsedRHS, err := parseString(test, k)
+				if err != nil {
+					ctx.errorf(pos, testStart+k+1, "couldn't parse regex value: %s", err.Error())
+					continue
+				}
+				rk.Value = parsedRHS.Value
+
+				rk.Regexp, err = regexp.Compile(magic.RegexSyntax(string(rk.Value), rk.Flags))
+				if err != nil {
+					ctx.errorf(pos, testStart+k+1, "invalid regex: %s", err.Error())
+					continue
+				}
+				// like POSIX regexec, prefer the longest match at the leftmost position
+				rk.Regexp.Longest()
+
+			case "offset":
+				ofk := &OffsetKind{}
+				rule.Kind.Family = KindFamilyOffset
+				rule.Kind.Data = ofk
+
+				ofk.IntegerTest = IntegerTestEqual
+
+				k := 0
+
+				switch at(test, k) {
+				case 'x':
+					ofk.MatchAny = true
+					k++
+				case '=':
+					k++
+				case '!':
+					ofk.IntegerTest = IntegerTestNotEqual
+					k++
+				case '<':
+					ofk.IntegerTest = IntegerTestLessThan
+					k++
+				case '>':
+					ofk.IntegerTest = IntegerTestGreaterThan
+					k++
+				}
+
+				if !ofk.MatchAny {
+					parsedValue, err := parseInt(test, k)
+					if err != nil {
+						ctx.errorf(pos, testStart+k+1, "couldn't parse offset value %q", test[k:])
+						continue
+					}
+					ofk.Value = parsedValue.Value
+				}
+
+			case "guid":
+				gk := &GUIDKind{}
+				rule.Kind.Family = KindFamilyGUID
+				rule.Kind.Data = gk
+
+				if string(test) == "x" {
+					gk.MatchAny = true
+				} else {
+					k := 0
+					if at(test, k) == '=' {
+						k++
+					}
+
+					value, err := magic.ParseGUID(string(test[k:]))
+					if err != nil {
+						ctx.errorf(pos, testStart+k+1, "couldn't parse guid value: %s", err.Error())
+						continue
+					}
+					gk.Value = value
+				}
+
+			case "der":
+				dk := &DERKind{}
+				rule.Kind.Family = KindFamilyDER
+				rule.Kind.Data = dk
+
+				if string(test) != "x" {
+					pattern, err := magic.ParseDERPattern(string(test))
+					if err != nil {
+						ctx.errorf(pos, testStart+1, "couldn't parse der test: %s", err.Error())
+						continue
+					}
+					dk.Value = string(test)
+					dk.Pattern = pattern
+				}
+
+			case "indirect":
+				ik := &IndirectKind{}
+				rule.Kind.Family = KindFamilyIndirect
+				rule.Kind.Data = ik
+
+				if j < len(kind) && kind[j] == '/' {
+					j++
+					for ; j < len(kind); j++ {
+						if kind[j] != 'r' {
+							ctx.errorf(pos, kindStart+j+1, "unknown indirect flag '%c'", kind[j])
+							break
+						}
+						ik.Relative = true
+					}
+					if j < len(kind) {
+						continue
+					}
+				}
+
+				if string(test) != "x" {
+					// the test is optional, so that's the description
+					descriptionBytes = lineBytes[testStart:]
+				}
+
 			case "default":
 				rule.Kind.Family = KindFamilyDefault
 			case "clear":
@@ -470,12 +885,13 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 
 				uk.Page = string(test[k:])
 			default:
-				ctx.Logf("unhandled kind (%s)\n", parsedKind.Value)
+				ctx.errorf(pos, kindStart+1, "unsupported kind %q", kind)
 				continue
 			}
 
 			rule.Description = descriptionBytes
 			book.AddRule(page, rule)
+			lastRule = book.lastRule(page)
 		}
 	}
 
@@ -0,0 +1,224 @@
+package parser
+
+import "sort"
+
+// strengthUnit is the base unit of rule strength, libmagic's MULT
+const strengthUnit = 10
+
+// Strength estimates how specific a rule is, the way libmagic does: the
+// more bytes a test looks at and the stricter its comparison, the stronger
+// it is. It's adjusted by the rule's "!:strength" annotation, if any.
+// Only default rules have a strength of 0.
+func (r Rule) Strength() int {
+	if r.Kind.Family == KindFamilyDefault {
+		// make sure those sort last
+		return 0
+	}
+
+	val := 2 * strengthUnit
+
+	switch r.Kind.Family {
+	case KindFamilyInteger:
+		ik, _ := r.Kind.Data.(*IntegerKind)
+		val += ik.ByteWidth * strengthUnit
+
+		switch {
+		case ik.MatchAny:
+			val = 0
+		case ik.IntegerTest == IntegerTestEqual:
+			val += strengthUnit
+		case ik.IntegerTest == IntegerTestNotEqual:
+			val = 0
+		case ik.IntegerTest == IntegerTestLessThan, ik.IntegerTest == IntegerTestGreaterThan:
+			val -= 2 * strengthUnit
+		case ik.IntegerTest == IntegerTestAnd, ik.IntegerTest == IntegerTestClear:
+			val -= strengthUnit
+		}
+	case KindFamilyString:
+		sk, _ := r.Kind.Data.(*StringKind)
+		val += len(sk.Value) * strengthUnit
+
+		switch {
+		case sk.MatchAny, sk.Negate:
+			val = 0
+		case sk.StringTest == IntegerTestLessThan, sk.StringTest == IntegerTestGreaterThan:
+			val -= 2 * strengthUnit
+		default:
+			val += strengthUnit
+		}
+	case KindFamilyFloat:
+		fk, _ := r.Kind.Data.(*FloatKind)
+		val += fk.ByteWidth * strengthUnit
+
+		switch {
+		case fk.MatchAny, fk.FloatTest == IntegerTestNotEqual:
+			val = 0
+		case fk.FloatTest == IntegerTestEqual:
+			val += strengthUnit
+		case fk.FloatTest == IntegerTestLessThan, fk.FloatTest == IntegerTestGreaterThan:
+			val -= 2 * strengthUnit
+		}
+	case KindFamilyPstring:
+		pk, _ := r.Kind.Data.(*PstringKind)
+		val += len(pk.Value) * strengthUnit
+
+		if pk.MatchAny || pk.Negate {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilyString16:
+		sk, _ := r.Kind.Data.(*String16Kind)
+		val += len(sk.Value) * strengthUnit / 2
+
+		if sk.MatchAny || sk.Negate {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilySearch:
+		sk, _ := r.Kind.Data.(*SearchKind)
+		if len(sk.Value) > 0 {
+			val += len(sk.Value) * maxInt(strengthUnit/len(sk.Value), 1)
+		}
+		if sk.Negate {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilyRegex:
+		rk, _ := r.Kind.Data.(*RegexKind)
+		n := nonMagicLen(rk.Value)
+		val += n * maxInt(strengthUnit/n, 1)
+
+		if rk.Negate {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilyOffset:
+		ofk, _ := r.Kind.Data.(*OffsetKind)
+		// offsets are 64-bit
+		val += 8 * strengthUnit
+
+		switch {
+		case ofk.MatchAny, ofk.IntegerTest == IntegerTestNotEqual:
+			val = 0
+		case ofk.IntegerTest == IntegerTestEqual:
+			val += strengthUnit
+		case ofk.IntegerTest == IntegerTestLessThan, ofk.IntegerTest == IntegerTestGreaterThan:
+			val -= 2 * strengthUnit
+		}
+	case KindFamilyGUID:
+		gk, _ := r.Kind.Data.(*GUIDKind)
+		// GUIDs are 16 bytes long
+		val += 16 * strengthUnit
+
+		if gk.MatchAny {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilyDER:
+		dk, _ := r.Kind.Data.(*DERKind)
+		if dk.Pattern == nil {
+			val = 0
+		} else {
+			val += strengthUnit
+		}
+	case KindFamilyIndirect:
+		// it matches anything, as far as strength is concerned
+		val = 0
+	case KindFamilyName, KindFamilyUse:
+		val += strengthUnit
+	case KindFamilyClear:
+		val = 0
+	}
+
+	switch r.StrengthAdjustmentType {
+	case AdjustmentAdd:
+		val += int(r.StrengthAdjustmentValue)
+	case AdjustmentSub:
+		val -= int(r.StrengthAdjustmentValue)
+	case AdjustmentMul:
+		val *= int(r.StrengthAdjustmentValue)
+	case AdjustmentDiv:
+		val /= int(r.StrengthAdjustmentValue)
+	}
+
+	if val <= 0 {
+		// only default rules get a strength of 0
+		val = 1
+	}
+
+	return val
+}
+
+// SortByStrength returns a copy of rules where each top-level rule (along
+// with the rules nested under it) is ordered from strongest to weakest.
+// Rules of equal strength keep the order they were read in.
+func SortByStrength(rules []Rule) []Rule {
+	type entry struct {
+		strength int
+		rules    []Rule
+	}
+
+	var entries []*entry
+	for _, rule := range rules {
+		if rule.Level == 0 || len(entries) == 0 {
+			entries = append(entries, &entry{
+				strength: rule.Strength(),
+			})
+		}
+		e := entries[len(entries)-1]
+		e.rules = append(e.rules, rule)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].strength > entries[j].strength
+	})
+
+	sorted := make([]Rule, 0, len(rules))
+	for _, e := range entries {
+		sorted = append(sorted, e.rules...)
+	}
+	return sorted
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// nonMagicLen counts the characters of a regular expression that match
+// literally, at least 1. Character classes and repetition counts are ignored.
+func nonMagicLen(pattern []byte) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			// escaped anything counts as one
+			i++
+			n++
+		case '?', '*', '.', '+', '^', '$':
+			// not literal
+		case '[':
+			for i < len(pattern) && pattern[i] != ']' {
+				i++
+			}
+		case '{':
+			for i < len(pattern) && pattern[i] != '}' {
+				i++
+			}
+		default:
+			n++
+		}
+	}
+
+	if n == 0 {
+		return 1
+	}
+	return n
+}
@@ -51,13 +51,23 @@ func ToUpper(b byte) byte {
 	return b
 }
 
+// ContainsString returns true if needle is one of the strings in haystack
+func ContainsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+var backspaceRegexp = regexp.MustCompile(`.\\b`)
+
 // MergeStrings concatenates a set of strings return by Identify into
 // a string that file(1) would print. For example, it handles \b.
 func MergeStrings(outStrings []string) string {
 	outString := strings.Join(outStrings, " ")
-
-	re := regexp.MustCompile(`.\\b`)
-	outString = re.ReplaceAllString(outString, "")
+	outString = backspaceRegexp.ReplaceAllString(outString, "")
 	outString = strings.TrimSpace(outString)
 
 	return outString